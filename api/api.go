@@ -3,36 +3,70 @@ package api
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/dberror"
 	"github.com/gamechanger/gcdb/locks"
 	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/planner"
 )
 
 const (
-	commandHi       = "hi"
-	commandInsert   = "insert"
-	commandFindId   = "findid"
-	commandFindAll  = "findall"
-	commandGetMore  = "getmore"
-	commandDeleteId = "deleteid"
-	commandUpdateId = "updateid"
-	commandIndex    = "index"
-	commandFlush    = "flush"
-	commandStats    = "stats"
-	commandHelp     = "help"
+	commandHi          = "hi"
+	commandInsert      = "insert"
+	commandInsertMany  = "insertmany"
+	commandFindId      = "findid"
+	commandFindAll     = "findall"
+	commandFind        = "find"
+	commandExplain     = "explain"
+	commandGetMore     = "getmore"
+	commandDeleteId    = "deleteid"
+	commandUpdateId    = "updateid"
+	commandIndex       = "index"
+	commandFlush       = "flush"
+	commandStats       = "stats"
+	commandCompact     = "compact"
+	commandVerify      = "verify"
+	commandCreateIndex = "createindex"
+	commandDropIndex   = "dropindex"
+	commandCreateColl  = "createcollection"
+	commandDropColl    = "dropcollection"
+	commandListColls   = "listcollections"
+	commandUse         = "use"
+	commandListDbs     = "listdatabases"
+	commandShutdown    = "shutdown"
+	commandKillCursor  = "killcursor"
+	commandCursors     = "cursors"
+	commandBegin       = "begin"
+	commandCommit      = "commit"
+	commandAbort       = "abort"
+	commandHelp        = "help"
 
 	responseHi   = "hello frand"
 	unrecognized = "Unrecognized command."
 )
 
-var useIndicesForQuery = false
 var responseHelp string
-var nextCursorId int
-var activeCursorOffsets map[int]uint32
+
+var getMoreBatchSize = constants.GetMoreBatchSize
+
+// Set by main to start a graceful shutdown
+var shutdownHook func()
+
+func SetGetMoreBatchSize(size int) {
+	getMoreBatchSize = size
+}
+
+// The shutdown command calls hook from a goroutine of its own,
+// so it should block until it's done if it wants to
+func OnShutdown(hook func()) {
+	shutdownHook = hook
+}
 
 type Command struct {
 	Command string
@@ -41,28 +75,17 @@ type Command struct {
 
 func init() {
 	responseHelp = "Command List\n"
-	for _, s := range []string{commandHi, commandInsert, commandFindId, commandFindAll, commandGetMore, commandDeleteId, commandUpdateId, commandIndex, commandFlush, commandStats} {
+	for _, s := range []string{commandHi, commandInsert, commandFindId, commandFindAll, commandFind, commandExplain, commandGetMore, commandDeleteId, commandUpdateId, commandIndex, commandFlush, commandStats, commandCompact, commandVerify, commandCreateIndex, commandDropIndex, commandCreateColl, commandDropColl, commandListColls, commandUse, commandListDbs, commandShutdown, commandKillCursor, commandCursors, commandBegin, commandCommit, commandAbort, commandInsertMany} {
 		responseHelp += s
 		responseHelp += "\n"
 	}
-	activeCursorOffsets = make(map[int]uint32)
+	activeCursors = make(map[int]*cursor)
 	nextCursorId = 1
-}
-
-// Initialize and return the ID of a new cursor
-func NewCursor() int {
-	newId := nextCursorId
-	activeCursorOffsets[newId] = memory.DataStartOffset
-	nextCursorId++
-	return newId
-}
-
-func updateCursor(cursorId int, newOffset uint32) {
-	activeCursorOffsets[cursorId] = newOffset
+	memory.OnCompaction(relocateCursors)
 }
 
 func NewCommandFromInput(buf []byte) *Command {
-	s := string(bytes.Trim(buf, string([]byte{0, 10})))
+	s := string(bytes.Trim(buf, string([]byte{0, 10, 13})))
 	pieces := strings.Split(s, " ")
 	var c *Command
 	if len(pieces) < 2 {
@@ -74,220 +97,333 @@ func NewCommandFromInput(buf []byte) *Command {
 	return c
 }
 
-func HandleCommand(command *Command) ([]byte, error) {
+// For commands that arrive with the name and body already split
+func NewCommand(name string, body []byte) *Command {
+	if len(body) == 0 {
+		return &Command{Command: name, Body: nil}
+	}
+	s := string(body)
+	return &Command{Command: name, Body: &s}
+}
+
+func HandleCommand(session *Session, command *Command) ([]byte, error) {
 	switch command.Command {
 	case commandHelp:
 		return []byte(responseHelp), nil
 	case commandHi:
 		return []byte(responseHi), nil
 	case commandInsert:
-		return insert(command)
+		return insert(session, command)
+	case commandInsertMany:
+		return insertMany(session, command)
 	case commandFlush:
-		return flush(command)
+		return flush(session, command)
 	case commandStats:
-		return stats(command)
+		return stats(session, command)
+	case commandCompact:
+		return compact(session, command)
+	case commandVerify:
+		return verify(session, command)
+	case commandCreateIndex:
+		return createIndex(session, command)
+	case commandDropIndex:
+		return dropIndex(session, command)
+	case commandCreateColl:
+		return createCollection(session, command)
+	case commandDropColl:
+		return dropCollection(session, command)
+	case commandListColls:
+		return listCollections(session, command)
+	case commandUse:
+		return use(session, command)
+	case commandListDbs:
+		return listDatabases(session, command)
+	case commandShutdown:
+		return shutdown(session, command)
 	case commandFindId:
-		return findId(command)
+		return findId(session, command)
 	case commandFindAll:
-		return findAll(command)
+		return findAll(session, command)
+	case commandFind:
+		return find(session, command)
+	case commandExplain:
+		return explain(session, command)
 	case commandGetMore:
-		return getMore(command)
+		return getMore(session, command)
+	case commandKillCursor:
+		return killCursor(session, command)
+	case commandCursors:
+		return listCursors(session, command)
+	case commandBegin:
+		return begin(session, command)
+	case commandCommit:
+		return commit(session, command)
+	case commandAbort:
+		return abort(session, command)
 	case commandDeleteId:
-		return deleteId(command)
+		return deleteId(session, command)
 	case commandUpdateId:
-		return updateId(command)
+		return updateId(session, command)
 	case commandIndex:
-		return toggleIndices(command)
+		return toggleIndices(session, command)
 	default:
-		return nil, errors.New(unrecognized)
+		return nil, dberror.New(dberror.BadRequest, unrecognized)
 	}
 }
 
-func insert(command *Command) ([]byte, error) {
-	if command.Body == nil {
-		return nil, errors.New("insert takes a JSON object as its command body")
+// Every command that works on a collection takes its name
+// as the first word of the body. Returns the name and whatever
+// comes after it, which is nil if nothing does.
+func splitCollection(command *Command, usage string) (string, *string, error) {
+	if command.Body == nil || *command.Body == "" {
+		return "", nil, dberror.New(dberror.BadRequest, usage)
 	}
-	unmarshaled := make(map[string]interface{})
-	err := json.Unmarshal([]byte(*command.Body), &unmarshaled)
+	pieces := strings.SplitN(*command.Body, " ", 2)
+	if len(pieces) < 2 || pieces[1] == "" {
+		return pieces[0], nil, nil
+	}
+	return pieces[0], &pieces[1], nil
+}
+
+// Look up the collection a command names, insisting on a body
+// after the name if needsBody is set
+func collectionArgument(session *Session, command *Command, usage string, needsBody bool) (*memory.Collection, *string, error) {
+	name, body, err := splitCollection(command, usage)
+	if err != nil {
+		return nil, nil, err
+	}
+	if needsBody && body == nil {
+		return nil, nil, dberror.New(dberror.BadRequest, usage)
+	}
+	coll, err := session.catalog.Collection(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return coll, body, nil
+}
+
+// Inserting into a collection that doesn't exist yet creates it
+func insert(session *Session, command *Command) ([]byte, error) {
+	usage := "insert takes a collection name and a JSON object as its command body"
+	name, body, err := splitCollection(command, usage)
 	if err != nil {
 		return nil, err
 	}
+	if body == nil {
+		return nil, dberror.New(dberror.BadRequest, usage)
+	}
+	idInt, data, err := prepareInsert([]byte(*body))
+	if err != nil {
+		return nil, err
+	}
+
+	coll, err := session.catalog.EnsureCollection(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyWrite(session, coll, memory.Write{Kind: memory.InsertWrite, Id: idInt, Data: data})
+}
+
+// Check a document has an integer _id and get it ready to store
+func prepareInsert(body []byte) (int, []byte, error) {
+	unmarshaled := make(map[string]interface{})
+	err := json.Unmarshal(body, &unmarshaled)
+	if err != nil {
+		return 0, nil, dberror.Wrap(dberror.BadRequest, err)
+	}
 
 	var id interface{}
 	var idFloat float64
 	var ok bool
 	if id, ok = unmarshaled["_id"]; !ok {
-		return nil, errors.New("Document must contain an integer _id field")
+		return 0, nil, dberror.New(dberror.BadRequest, "Document must contain an integer _id field")
 	}
 	if idFloat, ok = id.(float64); !ok {
-		return nil, errors.New("Document must contain an integer _id field")
+		return 0, nil, dberror.New(dberror.BadRequest, "Document must contain an integer _id field")
 	}
 	idInt := int(idFloat)
 	unmarshaled["_id"] = idInt
 
-	if memory.IdExistsInIndex(idInt) {
-		return nil, errors.New(fmt.Sprintf("Id %d violates unique constraint, another document already has this Id", idInt))
-	}
-
 	data, err := json.Marshal(unmarshaled)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
-
-	// TODO: Use channels for concurrency control instead of mutex
-	locks.GlobalWriteLock.Lock()
-	defer locks.GlobalWriteLock.Unlock()
-	memory.WriteDocumentToCurrentFile(idInt, data)
-	return []byte("OK"), nil
+	return idInt, data, nil
 }
 
-func flush(command *Command) ([]byte, error) {
-	err := memory.FlushCurrentFile()
+func flush(session *Session, command *Command) ([]byte, error) {
+	err := database.Flush()
 	if err != nil {
 		return nil, err
 	}
 	return []byte("OK"), nil
 }
 
-func findId(command *Command) ([]byte, error) {
-	if command.Body == nil {
-		return nil, errors.New("findid takes a document's integer ID as its command body")
+// Add "asof <version>" after the ID to read the document as it was then
+func findId(session *Session, command *Command) ([]byte, error) {
+	usage := "findid takes a collection name and a document's integer ID, optionally followed by asof and a version, as its command body"
+	coll, body, err := collectionArgument(session, command, usage, true)
+	if err != nil {
+		return nil, err
 	}
 
-	idInt, err := strconv.Atoi(*command.Body)
+	pieces := strings.Split(*body, " ")
+	if len(pieces) != 1 && (len(pieces) != 3 || pieces[1] != "asof") {
+		return nil, dberror.New(dberror.BadRequest, usage)
+	}
+	idInt, err := strconv.Atoi(pieces[0])
 	if err != nil {
-		return nil, err
+		return nil, dberror.Wrap(dberror.BadRequest, err)
 	}
 
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
 	var result *memory.Document
-	if useIndicesForQuery == false {
-		result, err = memory.CollectionScanCurrentDataFileForId(idInt)
+	if len(pieces) == 3 {
+		version, err := strconv.ParseUint(pieces[2], 10, 64)
+		if err != nil {
+			return nil, dberror.Wrap(dberror.BadRequest, err)
+		}
+		result, err = coll.FindIdAsOf(idInt, version)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		result, err = memory.IndexScanCurrentDataFileForId(idInt)
-	}
-	if err != nil {
-		return nil, err
+		result, err = planner.FindById(coll, idInt)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if result == nil {
-		return nil, errors.New(fmt.Sprintf("Id %d not found", idInt))
+		return nil, dberror.New(dberror.NotFound, fmt.Sprintf("Id %d not found", idInt))
 	}
 	return *result.Document, nil
 }
 
-func findAll(command *Command) ([]byte, error) {
-	// TODO: Put the version control stuff in cursors too
-	locks.GlobalCursorLock.Lock()
-	defer locks.GlobalCursorLock.Unlock()
-	cursorId := NewCursor()
-	return []byte(strconv.Itoa(cursorId)), nil
-}
-
-func getMore(command *Command) ([]byte, error) {
-	if command.Body == nil {
-		return nil, errors.New("findid takes a cursor's integer ID as its command body")
+func findAll(session *Session, command *Command) ([]byte, error) {
+	coll, body, err := collectionArgument(session, command, "findall takes a collection name and optionally a JSON object with batchSize and maxBytes as its command body", false)
+	if err != nil {
+		return nil, err
 	}
-
-	idInt, err := strconv.Atoi(*command.Body)
+	options, err := parseBatchOptions(body)
 	if err != nil {
 		return nil, err
 	}
 
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
 	locks.GlobalCursorLock.Lock()
 	defer locks.GlobalCursorLock.Unlock()
+	cursorId := NewCursor(session, coll, options)
+	return []byte(strconv.Itoa(cursorId)), nil
+}
 
-	offset, ok := activeCursorOffsets[idInt]
-	if !ok {
-		return nil, errors.New(fmt.Sprintf("Could not find cursor with Id %d", idInt))
-	}
-	result, err := memory.CollectionScanCurrentDataFileFromOffset(offset, 20)
+// Responds with a Batch, and frees the cursor once it has nothing left
+func getMore(session *Session, command *Command) ([]byte, error) {
+	// Same shape as a collection command, with the cursor in place of the name
+	id, body, err := splitCollection(command, "getmore takes a cursor's integer ID and optionally a JSON object with batchSize and maxBytes as its command body")
 	if err != nil {
 		return nil, err
 	}
-	if len(result) == 0 {
-		return nil, errors.New("cursor exhausted")
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, dberror.Wrap(dberror.BadRequest, err)
 	}
-
-	var idx int
-	output := make([]byte, 0)
-	for idx = range result {
-		output = append(output, *result[idx].Document...)
-		output = append(output, byte(10))
+	override, err := parseBatchOptions(body)
+	if err != nil {
+		return nil, err
 	}
-	updateCursor(idInt, (*result[idx]).NextOffset)
-	return output, nil
-}
 
-func deleteId(command *Command) ([]byte, error) {
-	if command.Body == nil {
-		return nil, errors.New("deleteid takes a document's integer ID as its command body")
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	locks.GlobalCursorLock.Lock()
+	c, ok := activeCursors[idInt]
+	locks.GlobalCursorLock.Unlock()
+	notFound := dberror.New(dberror.CursorNotFound, fmt.Sprintf("Could not find cursor with Id %d", idInt))
+	if !ok {
+		return nil, notFound
 	}
 
-	idInt, err := strconv.Atoi(*command.Body)
+	c.lock.Lock()
+	if c.freed {
+		c.lock.Unlock()
+		return nil, notFound
+	}
+	c.lastUsed = time.Now()
+	result, hasMore, err := c.nextBatch(c.options.merge(override))
+	c.lock.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	if !hasMore {
+		locks.GlobalCursorLock.Lock()
+		if activeCursors[idInt] == c {
+			freeCursor(idInt)
+		}
+		locks.GlobalCursorLock.Unlock()
+	}
 
-	// take the lock here so our snapshot doesn't move from under us
-	locks.GlobalWriteLock.Lock()
-	defer locks.GlobalWriteLock.Unlock()
-
-	var result *memory.Document
-	if useIndicesForQuery == false {
-		result, err = memory.CollectionScanCurrentDataFileForId(idInt)
-	} else {
-		result, err = memory.IndexScanCurrentDataFileForId(idInt)
+	batch := Batch{Cursor: idInt, Documents: make([]json.RawMessage, len(result)), HasMore: hasMore}
+	for idx := range result {
+		batch.Documents[idx] = json.RawMessage(result[idx])
 	}
+	return json.Marshal(batch)
+}
 
+func deleteId(session *Session, command *Command) ([]byte, error) {
+	coll, body, err := collectionArgument(session, command, "deleteid takes a collection name and a document's integer ID as its command body", true)
 	if err != nil {
 		return nil, err
 	}
-	if result == nil {
-		return nil, errors.New(fmt.Sprintf("Id %d not found", idInt))
-	}
 
-	err = memory.DeleteDocumentFromCurrentDataFileAtOffset(idInt, result.Offset)
+	idInt, err := strconv.Atoi(*body)
 	if err != nil {
-		return nil, err
+		return nil, dberror.Wrap(dberror.BadRequest, err)
 	}
-	return []byte("OK"), nil
+
+	return applyWrite(session, coll, memory.Write{Kind: memory.DeleteWrite, Id: idInt})
 }
 
-// Update is implemented as a delete followed by an insert
+// Update is implemented as a delete followed by an insert,
+// logged as one record so a crash can't leave just the delete
 // Does not currently upsert; if doc does not already exist
 // then the entire update will fail
-func updateId(command *Command) ([]byte, error) {
-	if command.Body == nil {
-		return nil, errors.New("updateid takes an integer ID and a new JSON doc as its command body")
+func updateId(session *Session, command *Command) ([]byte, error) {
+	usage := "updateid takes a collection name, an integer ID and a new JSON doc as its command body"
+	coll, body, err := collectionArgument(session, command, usage, true)
+	if err != nil {
+		return nil, err
 	}
 
-	pieces := strings.Split(*command.Body, " ")
+	pieces := strings.Split(*body, " ")
 	if len(pieces) < 2 {
-		return nil, errors.New("updateid takes an integer ID and a new JSON doc as its command body")
+		return nil, dberror.New(dberror.BadRequest, usage)
 	}
 
 	idInt, err := strconv.Atoi(pieces[0])
 	if err != nil {
-		return nil, err
+		return nil, dberror.Wrap(dberror.BadRequest, err)
 	}
 
 	unmarshaled := make(map[string]interface{})
 	err = json.Unmarshal([]byte(strings.Join(pieces[1:], " ")), &unmarshaled)
 	if err != nil {
-		return nil, err
+		return nil, dberror.Wrap(dberror.BadRequest, err)
 	}
 
 	var id interface{}
 	var idFloat float64
 	var ok bool
 	if id, ok = unmarshaled["_id"]; !ok {
-		return nil, errors.New("Document must contain an integer _id field")
+		return nil, dberror.New(dberror.BadRequest, "Document must contain an integer _id field")
 	}
 	if idFloat, ok = id.(float64); !ok {
-		return nil, errors.New("Document must contain an integer _id field")
+		return nil, dberror.New(dberror.BadRequest, "Document must contain an integer _id field")
 	}
 	if int(idFloat) != idInt {
-		return nil, errors.New("New document must have same _id as document being updated")
+		return nil, dberror.New(dberror.BadRequest, "New document must have same _id as document being updated")
 	}
 
 	data, err := json.Marshal(unmarshaled)
@@ -295,46 +431,150 @@ func updateId(command *Command) ([]byte, error) {
 		return nil, err
 	}
 
+	return applyWrite(session, coll, memory.Write{Kind: memory.UpdateWrite, Id: idInt, Data: data})
+}
+
+// The planner picks its own indexes, this is a debugging override
+// that makes every query scan the whole collection while it's off
+func toggleIndices(session *Session, command *Command) ([]byte, error) {
+	if command.Body == nil {
+		return nil, dberror.New(dberror.BadRequest, "index takes either 'on' or 'off' as its body")
+	}
+
+	// Queries read this under the read lock
 	locks.GlobalWriteLock.Lock()
 	defer locks.GlobalWriteLock.Unlock()
+	if *command.Body == "on" {
+		planner.ForceCollectionScans = false
+		return []byte("INDICES ON"), nil
+	} else if *command.Body == "off" {
+		planner.ForceCollectionScans = true
+		return []byte("INDICES OFF"), nil
+	}
+	return nil, dberror.New(dberror.BadRequest, "index takes either 'on' or 'off' as its body")
+}
 
-	var result *memory.Document
-	if useIndicesForQuery == false {
-		result, err = memory.CollectionScanCurrentDataFileForId(idInt)
-	} else {
-		result, err = memory.IndexScanCurrentDataFileForId(idInt)
+// With a collection name this is that collection's stats,
+// without one it's a document count for every collection
+func stats(session *Session, command *Command) ([]byte, error) {
+	if command.Body != nil {
+		coll, _, err := collectionArgument(session, command, "stats takes an optional collection name as its command body", false)
+		if err != nil {
+			return nil, err
+		}
+		locks.GlobalWriteLock.RLock()
+		defer locks.GlobalWriteLock.RUnlock()
+		return coll.Stats(), nil
+	}
+
+	// Look them all up before taking the write lock, the metadata lock comes first
+	names := session.catalog.CollectionNames()
+	colls := make([]*memory.Collection, 0, len(names))
+	for _, name := range names {
+		coll, err := session.catalog.Collection(name)
+		if err != nil {
+			continue
+		}
+		colls = append(colls, coll)
+	}
+
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	output := fmt.Sprintf("Collections: %d", len(colls))
+	for _, coll := range colls {
+		output += fmt.Sprintf("\n%s: %d documents", coll.Name, coll.Len())
+	}
+	return []byte(output), nil
+}
+
+func compact(session *Session, command *Command) ([]byte, error) {
+	coll, _, err := collectionArgument(session, command, "compact takes a collection name as its command body", false)
+	if err != nil {
+		return nil, err
 	}
+	result, err := coll.Compact()
 	if err != nil {
 		return nil, err
 	}
-	if result == nil {
-		return nil, errors.New(fmt.Sprintf("Id %d not found", idInt))
+	return []byte(fmt.Sprintf("OK, reclaimed %d bytes, %d data files down to %d", result.BytesReclaimed, result.FilesBefore, result.FilesAfter)), nil
+}
+
+func verify(session *Session, command *Command) ([]byte, error) {
+	coll, _, err := collectionArgument(session, command, "verify takes a collection name as its command body", false)
+	if err != nil {
+		return nil, err
 	}
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	report, err := coll.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(report.String()), nil
+}
 
-	err = memory.DeleteDocumentFromCurrentDataFileAtOffset(idInt, result.Offset)
+func createIndex(session *Session, command *Command) ([]byte, error) {
+	coll, body, err := collectionArgument(session, command, "createindex takes a collection name and a dotted field path as its command body", true)
 	if err != nil {
 		return nil, err
 	}
 
-	memory.WriteDocumentToCurrentFile(idInt, data)
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	numEntries, err := coll.CreateSecondaryIndex(*body)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("OK, indexed %d documents", numEntries)), nil
+}
+
+func dropIndex(session *Session, command *Command) ([]byte, error) {
+	coll, body, err := collectionArgument(session, command, "dropindex takes a collection name and a dotted field path as its command body", true)
+	if err != nil {
+		return nil, err
+	}
+
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	err = coll.DropSecondaryIndex(*body)
+	if err != nil {
+		return nil, err
+	}
 	return []byte("OK"), nil
 }
 
-func toggleIndices(command *Command) ([]byte, error) {
+func createCollection(session *Session, command *Command) ([]byte, error) {
 	if command.Body == nil {
-		return nil, errors.New("index takes either 'on' or 'off' as its body")
+		return nil, dberror.New(dberror.BadRequest, "createcollection takes a collection name as its command body")
+	}
+	_, err := session.catalog.CreateCollection(*command.Body)
+	if err != nil {
+		return nil, err
 	}
+	return []byte("OK"), nil
+}
 
-	if *command.Body == "on" {
-		useIndicesForQuery = true
-		return []byte("INDICES ON"), nil
-	} else if *command.Body == "off" {
-		useIndicesForQuery = false
-		return []byte("INDICES OFF"), nil
+func dropCollection(session *Session, command *Command) ([]byte, error) {
+	if command.Body == nil {
+		return nil, dberror.New(dberror.BadRequest, "dropcollection takes a collection name as its command body")
+	}
+	err := session.catalog.DropCollection(*command.Body)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("index takes either 'on' or 'off' as its body")
+	return []byte("OK"), nil
+}
+
+func listCollections(session *Session, command *Command) ([]byte, error) {
+	return []byte(strings.Join(session.catalog.CollectionNames(), "\n")), nil
 }
 
-func stats(command *Command) ([]byte, error) {
-	return memory.Stats(), nil
+// The reply goes out before the server stops, since
+// shutting down waits for in-flight commands to finish
+func shutdown(session *Session, command *Command) ([]byte, error) {
+	if shutdownHook == nil {
+		return nil, dberror.New(dberror.Internal, "This server can't be shut down with a command")
+	}
+	go shutdownHook()
+	return []byte("OK, shutting down"), nil
 }
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gcdb-api")
+	if err != nil {
+		panic(err)
+	}
+	filesystem.SetDataDir(dir)
+	filesystem.SetDataFileSize(1 << 16)
+	memory.SetWALSyncPolicy(wal.SyncNever, 0)
+	memory.StartWriter()
+	status := m.Run()
+	database.CloseAll()
+	os.RemoveAll(dir)
+	os.Exit(status)
+}
+
+var unsafeNameChars = regexp.MustCompile("[^A-Za-z0-9_-]")
+
+// A session using a database of its own, so
+// tests don't trip over each other's collections
+func newTestSession(t *testing.T) *Session {
+	t.Helper()
+	session, err := NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, session, "use "+unsafeNameChars.ReplaceAllString(t.Name(), "_"))
+	return session
+}
+
+func run(t *testing.T, session *Session, input string) string {
+	t.Helper()
+	response, err := HandleCommand(session, NewCommandFromInput([]byte(input)))
+	if err != nil {
+		t.Fatalf("%s: %v", input, err)
+	}
+	return string(response)
+}
+
+// Run a command that ought to fail with the given code
+func runFailing(t *testing.T, session *Session, input string, code dberror.Code) error {
+	t.Helper()
+	response, err := HandleCommand(session, NewCommandFromInput([]byte(input)))
+	if err == nil {
+		t.Fatalf("%s succeeded with %s", input, response)
+	}
+	if dberror.CodeOf(err) != code {
+		t.Fatalf("%s failed with %v, want %s", input, err, code)
+	}
+	return err
+}
+
+func expectFound(t *testing.T, session *Session, coll string, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		run(t, session, fmt.Sprintf("findid %s %d", coll, id))
+	}
+}
+
+func expectNotFound(t *testing.T, session *Session, coll string, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		runFailing(t, session, fmt.Sprintf("findid %s %d", coll, id), dberror.NotFound)
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/memory"
+)
+
+// insertmany takes either a JSON array of documents or an object like
+// {"documents": [...], "ordered": false}. Each document is inserted as
+// if on its own, but they all go to the writer together. Ordered, the
+// default, stops at the first document that can't be inserted and
+// leaves the rest alone; unordered tries every one of them. Either way
+// the reply says how many went in and what was wrong with the others.
+
+type insertManyRequest struct {
+	Documents []json.RawMessage `json:"documents"`
+	Ordered   *bool             `json:"ordered"`
+}
+
+// What insertmany sends back, with errors in document order
+type InsertManyResult struct {
+	Inserted int           `json:"inserted"`
+	Errors   []InsertError `json:"errors"`
+}
+
+type InsertError struct {
+	// Position of the document in the request
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func insertError(index int, err error) InsertError {
+	return InsertError{Index: index, Code: dberror.CodeOf(err).String(), Message: err.Error()}
+}
+
+func insertMany(session *Session, command *Command) ([]byte, error) {
+	usage := "insertmany takes a collection name and either a JSON array of documents or a JSON object with documents and ordered as its command body"
+	name, body, err := splitCollection(command, usage)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, dberror.New(dberror.BadRequest, usage)
+	}
+	request, err := parseInsertMany([]byte(*body))
+	if err != nil {
+		return nil, err
+	}
+	coll, err := session.catalog.EnsureCollection(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A transaction is all or nothing anyway, so there's nothing to order
+	if session.txn != nil {
+		writes := make([]memory.Write, 0, len(request.Documents))
+		for idx, doc := range request.Documents {
+			id, data, err := prepareInsert(doc)
+			if err != nil {
+				return nil, dberror.New(dberror.BadRequest, fmt.Sprintf("Document %d: %v", idx, err))
+			}
+			writes = append(writes, memory.Write{Kind: memory.InsertWrite, Id: id, Data: data})
+		}
+		for _, write := range writes {
+			err = session.txn.add(coll, write)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return []byte(fmt.Sprintf("OK, queued %d writes", len(writes))), nil
+	}
+
+	ordered := request.Ordered == nil || *request.Ordered
+	result, err := InsertMany(coll, request.Documents, ordered)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+func parseInsertMany(body []byte) (*insertManyRequest, error) {
+	request := &insertManyRequest{}
+	var err error
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &request.Documents)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(request)
+	}
+	if err != nil {
+		return nil, dberror.Wrap(dberror.BadRequest, err)
+	}
+	return request, nil
+}
+
+// Insert every document that can be, each as a write of its own, and
+// say what happened to the rest. The collection must already exist.
+// Returns an error instead if none of them could be tried, like when
+// the collection is dropped.
+func InsertMany(coll *memory.Collection, docs []json.RawMessage, ordered bool) (*InsertManyResult, error) {
+	result := &InsertManyResult{Errors: make([]InsertError, 0)}
+	groups := make([][]memory.Write, 0, len(docs))
+	// Which document each group came from
+	indexes := make([]int, 0, len(docs))
+	invalid := make([]InsertError, 0)
+	for idx, doc := range docs {
+		id, data, err := prepareInsert(doc)
+		if err != nil {
+			invalid = append(invalid, insertError(idx, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		groups = append(groups, []memory.Write{{Kind: memory.InsertWrite, Id: id, Data: data}})
+		indexes = append(indexes, idx)
+	}
+
+	results, err := coll.ApplyWriteGroups(groups, ordered)
+	if err != nil {
+		return nil, err
+	}
+	failed := false
+	for idx, err := range results {
+		if err != nil {
+			result.Errors = append(result.Errors, insertError(indexes[idx], err))
+			failed = true
+			continue
+		}
+		result.Inserted++
+	}
+	// Ordered, a failed write means we never got as far as a bad document
+	if !ordered || !failed {
+		result.Errors = append(result.Errors, invalid...)
+	}
+	sort.Slice(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Index < result.Errors[j].Index
+	})
+	return result, nil
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gamechanger/gcdb/dberror"
+)
+
+func runInsertMany(t *testing.T, session *Session, body string) *InsertManyResult {
+	t.Helper()
+	result := &InsertManyResult{}
+	err := json.Unmarshal([]byte(run(t, session, "insertmany things "+body)), result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func errorIndexes(result *InsertManyResult) []int {
+	indexes := make([]int, 0, len(result.Errors))
+	for _, insertErr := range result.Errors {
+		indexes = append(indexes, insertErr.Index)
+	}
+	return indexes
+}
+
+func TestOrderedInsertManyStopsAtFirstFailure(t *testing.T) {
+	session := newTestSession(t)
+	run(t, session, `insert things {"_id":3}`)
+
+	result := runInsertMany(t, session, `[{"_id":1}, {"_id":2}, {"_id":3}, {"_id":4}, {"nope":5}]`)
+	if result.Inserted != 2 || fmt.Sprint(errorIndexes(result)) != "[2]" || result.Errors[0].Code != "DuplicateKey" {
+		t.Fatalf("got %+v", result)
+	}
+	expectFound(t, session, "things", 1, 2)
+	expectNotFound(t, session, "things", 4)
+
+	// A bad document stops it before anything after it is written
+	result = runInsertMany(t, session, `{"documents": [{"_id":10}, {"nope":11}, {"_id":12}]}`)
+	if result.Inserted != 1 || fmt.Sprint(errorIndexes(result)) != "[1]" || result.Errors[0].Code != "BadRequest" {
+		t.Fatalf("got %+v", result)
+	}
+	expectNotFound(t, session, "things", 12)
+
+	// Even when it's the very first one
+	result = runInsertMany(t, session, `[{"nope":20}, {"_id":21}]`)
+	if result.Inserted != 0 || fmt.Sprint(errorIndexes(result)) != "[0]" {
+		t.Fatalf("got %+v", result)
+	}
+	expectNotFound(t, session, "things", 21)
+}
+
+func TestUnorderedInsertManyTriesEveryDocument(t *testing.T) {
+	session := newTestSession(t)
+	run(t, session, `insert things {"_id":3}`)
+
+	result := runInsertMany(t, session, `{"documents": [{"_id":1}, {"nope":2}, {"_id":3}, {"_id":4}, {"_id":1}], "ordered": false}`)
+	if result.Inserted != 2 || fmt.Sprint(errorIndexes(result)) != "[1 2 4]" {
+		t.Fatalf("got %+v", result)
+	}
+	expectFound(t, session, "things", 1, 3, 4)
+}
+
+func TestInsertManyIntoDroppedCollection(t *testing.T) {
+	session := newTestSession(t)
+	run(t, session, `insert things {"_id":1}`)
+	coll, err := session.catalog.Collection("things")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, session, "dropcollection things")
+
+	docs := []json.RawMessage{json.RawMessage(`{"nope":1}`), json.RawMessage(`{"_id":2}`)}
+	for _, ordered := range []bool{true, false} {
+		for _, from := range []int{0, 1} {
+			result, err := InsertMany(coll, docs[from:], ordered)
+			if result != nil || !dberror.Is(err, dberror.NotFound) {
+				t.Fatalf("ordered %v from %d: got %+v and %v", ordered, from, result, err)
+			}
+		}
+	}
+}
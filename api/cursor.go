@@ -0,0 +1,322 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/query"
+)
+
+// A cursor either walks the data files from a location, filtering
+// as it goes if it has a query, or hands out results that were
+// worked out up front when a find needed sorting or used an index.
+// Walking cursors pin a snapshot of the collection when they're
+// created, so every batch comes from the same point in time.
+// Cursors go away once getmore has returned their last document, when they're
+// killed, when the connection that opened them closes, or after
+// sitting idle for longer than the cursor timeout.
+// The cursor lock guards the set of cursors, and each cursor has a lock
+// of its own for its position, so getmores on different cursors can
+// read at the same time. Take the cursor lock first if you need both.
+
+type cursor struct {
+	lock     sync.Mutex
+	coll     *memory.Collection
+	location memory.Location
+	query    *query.Query
+	// Documents ready to hand out, all of them if the
+	// cursor isn't scanning, otherwise read ahead of getmore
+	results  [][]byte
+	scanning bool
+	snapshot memory.Snapshot
+	matched  int
+	returned int
+	options  batchOptions
+	session  *Session
+	database string
+	created  time.Time
+	lastUsed time.Time
+	// Set once it's been freed, for anyone who looked it up just before
+	freed bool
+}
+
+var nextCursorId int
+var activeCursors map[int]*cursor
+
+var cursorTimeout = constants.CursorTimeoutSeconds * time.Second
+
+func SetCursorTimeout(timeout time.Duration) {
+	cursorTimeout = timeout
+}
+
+// Initialize and return the ID of a new cursor over every document in coll
+func NewCursor(session *Session, coll *memory.Collection, options batchOptions) int {
+	return registerCursor(session, &cursor{coll: coll, location: memory.FirstLocation(), scanning: true, options: options})
+}
+
+func registerCursor(session *Session, c *cursor) int {
+	newId := nextCursorId
+	c.session = session
+	c.database = session.Database
+	c.created = time.Now()
+	c.lastUsed = c.created
+	if c.scanning {
+		c.snapshot = c.coll.PinSnapshot()
+	}
+	activeCursors[newId] = c
+	nextCursorId++
+	return newId
+}
+
+// Free every cursor the session opened, called when its connection closes
+func (session *Session) Close() {
+	locks.GlobalCursorLock.Lock()
+	defer locks.GlobalCursorLock.Unlock()
+	for id, c := range activeCursors {
+		if c.session == session {
+			freeCursor(id)
+		}
+	}
+}
+
+// Every so often throw away cursors nobody has touched in a while
+func StartCursorReaper() {
+	interval := cursorTimeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		for range time.Tick(interval) {
+			reapIdleCursors(time.Now())
+		}
+	}()
+}
+
+func reapIdleCursors(now time.Time) {
+	locks.GlobalCursorLock.Lock()
+	defer locks.GlobalCursorLock.Unlock()
+	for id, c := range activeCursors {
+		c.lock.Lock()
+		idle := now.Sub(c.lastUsed)
+		c.lock.Unlock()
+		if idle > cursorTimeout {
+			logging.Debugf("Cursor %d timed out after %v idle", id, idle)
+			freeCursor(id)
+		}
+	}
+}
+
+// Callers must hold the cursor lock
+func freeCursor(id int) {
+	c := activeCursors[id]
+	c.lock.Lock()
+	if c.scanning {
+		c.finishScan()
+	}
+	c.freed = true
+	c.lock.Unlock()
+	delete(activeCursors, id)
+}
+
+func killCursor(session *Session, command *Command) ([]byte, error) {
+	if command.Body == nil {
+		return nil, dberror.New(dberror.BadRequest, "killcursor takes a cursor's integer ID as its command body")
+	}
+	idInt, err := strconv.Atoi(*command.Body)
+	if err != nil {
+		return nil, dberror.Wrap(dberror.BadRequest, err)
+	}
+
+	locks.GlobalCursorLock.Lock()
+	defer locks.GlobalCursorLock.Unlock()
+	if _, ok := activeCursors[idInt]; !ok {
+		return nil, dberror.New(dberror.CursorNotFound, fmt.Sprintf("Could not find cursor with Id %d", idInt))
+	}
+	freeCursor(idInt)
+	return []byte("OK"), nil
+}
+
+// One line per open cursor, oldest first
+func listCursors(session *Session, command *Command) ([]byte, error) {
+	locks.GlobalCursorLock.Lock()
+	defer locks.GlobalCursorLock.Unlock()
+	ids := make([]int, 0, len(activeCursors))
+	for id := range activeCursors {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	now := time.Now()
+	output := ""
+	for _, id := range ids {
+		c := activeCursors[id]
+		c.lock.Lock()
+		output += fmt.Sprintf("Cursor %d on %s.%s: age %.1fs, idle %.1fs, %s, %d returned\n",
+			id, c.database, c.coll.Name, now.Sub(c.created).Seconds(), now.Sub(c.lastUsed).Seconds(), c.position(), c.returned)
+		c.lock.Unlock()
+	}
+	if output == "" {
+		return []byte("No open cursors"), nil
+	}
+	return []byte(output[:len(output)-1]), nil
+}
+
+func (c *cursor) position() string {
+	if !c.scanning {
+		return fmt.Sprintf("%d results left", len(c.results))
+	}
+	return fmt.Sprintf("at data.%d offset %d of version %d", c.location.File, c.location.Offset, c.snapshot.Version)
+}
+
+// Runs with the world stopped, so we already hold the cursor lock,
+// and nobody can be in a getmore since that needs the write lock
+func relocateCursors(result *memory.CompactionResult) {
+	for _, c := range activeCursors {
+		if c.coll == result.Collection {
+			c.location = result.Relocate(c.location)
+			c.snapshot = c.snapshot.Relocate(result)
+		}
+	}
+}
+
+// Limits on a single getmore, zero leaves it to the cursor or the server
+type batchOptions struct {
+	BatchSize int `json:"batchSize"`
+	MaxBytes  int `json:"maxBytes"`
+}
+
+func parseBatchOptions(body *string) (batchOptions, error) {
+	options := batchOptions{}
+	if body == nil {
+		return options, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(*body))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&options)
+	if err != nil {
+		return options, dberror.Wrap(dberror.BadRequest, err)
+	}
+	if options.BatchSize < 0 || options.MaxBytes < 0 {
+		return options, dberror.New(dberror.BadRequest, "batchSize and maxBytes must not be negative")
+	}
+	return options, nil
+}
+
+// Anything set in override wins, then the cursor's own, then the default
+func (o batchOptions) merge(override batchOptions) batchOptions {
+	if override.BatchSize > 0 {
+		o.BatchSize = override.BatchSize
+	}
+	if override.MaxBytes > 0 {
+		o.MaxBytes = override.MaxBytes
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = getMoreBatchSize
+	}
+	return o
+}
+
+// What getmore sends back
+type Batch struct {
+	Cursor    int               `json:"cursor"`
+	Documents []json.RawMessage `json:"documents"`
+	HasMore   bool              `json:"hasMore"`
+}
+
+// Return the next batch of documents and whether there are any left.
+// A batch always holds at least one document if there are any, even
+// if that one document is over the byte limit.
+func (c *cursor) nextBatch(options batchOptions) ([][]byte, bool, error) {
+	// Read one past the batch so we know whether there's more
+	for c.scanning && len(c.results) <= options.BatchSize {
+		err := c.scan(options.BatchSize + 1 - len(c.results))
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	batch := make([][]byte, 0, options.BatchSize)
+	size := 0
+	for len(c.results) > 0 && len(batch) < options.BatchSize {
+		next := c.results[0]
+		if options.MaxBytes > 0 && len(batch) > 0 && size+len(next) > options.MaxBytes {
+			break
+		}
+		batch = append(batch, next)
+		size += len(next)
+		c.results = c.results[1:]
+	}
+	c.returned += len(batch)
+	return batch, c.scanning || len(c.results) > 0, nil
+}
+
+// Walk the data files until n more documents match or we run out
+func (c *cursor) scan(n int) error {
+	found := 0
+	for found < n {
+		docs, err := c.coll.CollectionScanFromLocation(c.location, c.snapshot, n)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			c.location = doc.Next
+			output, matched := *doc.Document, true
+			if c.query != nil {
+				output, matched, err = applyQuery(c.query, output)
+				if err != nil {
+					return err
+				}
+			}
+			if matched {
+				c.results = append(c.results, output)
+				c.matched++
+				found++
+			}
+			if c.query != nil && c.query.Limit > 0 && c.matched == c.query.Limit {
+				c.finishScan()
+				return nil
+			}
+			if found == n {
+				return nil
+			}
+		}
+		if len(docs) < n {
+			c.finishScan()
+			return nil
+		}
+	}
+	return nil
+}
+
+// Nothing left in the snapshot we need, so let compaction have it
+func (c *cursor) finishScan() {
+	c.scanning = false
+	c.coll.UnpinSnapshot(c.snapshot)
+}
+
+// Returns the document with the query's projection applied if it matches
+func applyQuery(q *query.Query, data []byte) ([]byte, bool, error) {
+	unmarshaled := make(map[string]interface{})
+	err := json.Unmarshal(data, &unmarshaled)
+	if err != nil {
+		return nil, false, err
+	}
+	if !q.Matches(unmarshaled) {
+		return nil, false, nil
+	}
+	if q.Projection == nil {
+		return data, true, nil
+	}
+	output, err := json.Marshal(q.Project(unmarshaled))
+	return output, true, err
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func insertTestDocs(t *testing.T, session *Session, coll string, from, to int) {
+	t.Helper()
+	for id := from; id < to; id++ {
+		run(t, session, fmt.Sprintf(`insert %s {"_id":%d}`, coll, id))
+	}
+}
+
+// Page through a cursor, returning the _ids of everything it hands out
+func drainCursor(t *testing.T, session *Session, cursor string, between func()) []int {
+	t.Helper()
+	ids := make([]int, 0)
+	for {
+		batch := Batch{}
+		err := json.Unmarshal([]byte(run(t, session, "getmore "+cursor)), &batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range batch.Documents {
+			doc := struct {
+				Id int `json:"_id"`
+			}{}
+			err = json.Unmarshal(data, &doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, doc.Id)
+		}
+		if !batch.HasMore {
+			return ids
+		}
+		if between != nil {
+			between()
+			between = nil
+		}
+	}
+}
+
+func TestCursorKeepsItsSnapshot(t *testing.T) {
+	session := newTestSession(t)
+	insertTestDocs(t, session, "things", 0, 10)
+	cursor := run(t, session, `findall things {"batchSize": 3}`)
+
+	ids := drainCursor(t, session, cursor, func() {
+		for id := 0; id < 10; id += 2 {
+			run(t, session, fmt.Sprintf("deleteid things %d", id))
+		}
+		run(t, session, `updateid things 9 {"_id":9,"changed":true}`)
+		insertTestDocs(t, session, "things", 100, 103)
+		// Compaction has to keep what the cursor still needs
+		run(t, session, "compact things")
+	})
+	if fmt.Sprint(ids) != fmt.Sprint([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Fatalf("cursor returned %v", ids)
+	}
+
+	// A new cursor sees things as they are now
+	cursor = run(t, session, `findall things {"batchSize": 3}`)
+	ids = drainCursor(t, session, cursor, nil)
+	if fmt.Sprint(ids) != fmt.Sprint([]int{1, 3, 5, 7, 9, 100, 101, 102}) {
+		t.Fatalf("new cursor returned %v", ids)
+	}
+}
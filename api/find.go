@@ -0,0 +1,139 @@
+package api
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/planner"
+	"github.com/gamechanger/gcdb/query"
+)
+
+type candidate struct {
+	data        []byte
+	unmarshaled map[string]interface{}
+}
+
+type explanation struct {
+	Plan                string  `json:"plan"`
+	Index               string  `json:"index,omitempty"`
+	KeysExamined        int     `json:"keysExamined"`
+	DocsExamined        int     `json:"docsExamined"`
+	DocsReturned        int     `json:"docsReturned"`
+	ExecutionTimeMillis float64 `json:"executionTimeMillis"`
+}
+
+// Returns a cursor id just like findall, page through it with getmore
+func find(session *Session, command *Command) ([]byte, error) {
+	coll, body, err := collectionArgument(session, command, "find takes a collection name and a JSON query as its command body", true)
+	if err != nil {
+		return nil, err
+	}
+	q, err := query.Parse([]byte(*body))
+	if err != nil {
+		return nil, dberror.Wrap(dberror.BadRequest, err)
+	}
+
+	c := &cursor{
+		coll:     coll,
+		location: memory.FirstLocation(),
+		query:    q,
+		options:  batchOptions{BatchSize: q.BatchSize, MaxBytes: q.MaxBytes},
+	}
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	// A plain collection scan without a sort can filter lazily
+	// as getmore walks the data files
+	plan := planner.Choose(coll, q)
+	if plan.Kind == planner.CollectionScan && q.Sort == nil {
+		c.scanning = true
+	} else {
+		c.results, err = materialize(q, plan, &planner.Stats{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	locks.GlobalCursorLock.Lock()
+	defer locks.GlobalCursorLock.Unlock()
+	cursorId := registerCursor(session, c)
+	return []byte(strconv.Itoa(cursorId)), nil
+}
+
+// Run a find query to completion and report how it went
+func explain(session *Session, command *Command) ([]byte, error) {
+	coll, body, err := collectionArgument(session, command, "explain takes a collection name and a JSON query as its command body, same as find", true)
+	if err != nil {
+		return nil, err
+	}
+	q, err := query.Parse([]byte(*body))
+	if err != nil {
+		return nil, dberror.Wrap(dberror.BadRequest, err)
+	}
+
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	start := time.Now()
+	plan := planner.Choose(coll, q)
+	stats := &planner.Stats{}
+	_, err = materialize(q, plan, stats)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(explanation{
+		Plan:                plan.String(),
+		Index:               plan.Index,
+		KeysExamined:        stats.KeysExamined,
+		DocsExamined:        stats.DocsExamined,
+		DocsReturned:        stats.DocsReturned,
+		ExecutionTimeMillis: float64(time.Now().Sub(start)) / float64(time.Millisecond),
+	})
+}
+
+// Work out the full result set of a query up front
+func materialize(q *query.Query, plan *planner.Plan, stats *planner.Stats) ([][]byte, error) {
+	matches := make([]candidate, 0)
+	err := plan.Candidates(stats, func(doc *memory.Document) (bool, error) {
+		unmarshaled := make(map[string]interface{})
+		err := json.Unmarshal(*doc.Document, &unmarshaled)
+		if err != nil {
+			return false, err
+		}
+		if q.Matches(unmarshaled) {
+			matches = append(matches, candidate{data: *doc.Document, unmarshaled: unmarshaled})
+		}
+		// Without a sort the first matches are as good as any
+		return q.Sort != nil || q.Limit == 0 || len(matches) < q.Limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Sort != nil {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return q.Less(matches[i].unmarshaled, matches[j].unmarshaled)
+		})
+	}
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	results := make([][]byte, 0, len(matches))
+	for _, match := range matches {
+		if q.Projection == nil {
+			results = append(results, match.data)
+			continue
+		}
+		output, err := json.Marshal(q.Project(match.unmarshaled))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, output)
+	}
+	stats.DocsReturned = len(results)
+	return results, nil
+}
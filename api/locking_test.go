@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/locks"
+)
+
+// Run input on a goroutine of its own, the channel gets the error
+func runAsync(session *Session, input string) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := HandleCommand(session, NewCommandFromInput([]byte(input)))
+		done <- err
+	}()
+	return done
+}
+
+func TestReadsDontWaitForEachOther(t *testing.T) {
+	session := newTestSession(t)
+	run(t, session, `insert things {"_id":1}`)
+
+	// As if a long read were going on
+	locks.GlobalWriteLock.RLock()
+	select {
+	case err := <-runAsync(session, "findid things 1"):
+		if err != nil {
+			locks.GlobalWriteLock.RUnlock()
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		locks.GlobalWriteLock.RUnlock()
+		t.Fatal("a read waited for another read")
+	}
+
+	// but writes have to wait for it
+	insertDone := runAsync(session, `insert things {"_id":2}`)
+	select {
+	case err := <-insertDone:
+		locks.GlobalWriteLock.RUnlock()
+		t.Fatalf("a write went ahead during a read: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	locks.GlobalWriteLock.RUnlock()
+	if err := <-insertDone; err != nil {
+		t.Fatal(err)
+	}
+	expectFound(t, session, "things", 2)
+}
+
+// Writers keep a and b equal in every document, so a reader that
+// sees them differ caught a document half way through changing
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	const numDocs = 50
+	const rounds = 30
+	setup := newTestSession(t)
+	for id := 0; id < numDocs; id++ {
+		run(t, setup, fmt.Sprintf(`insert things {"_id":%d,"a":0,"b":0}`, id))
+	}
+	run(t, setup, "createindex things a")
+
+	errs := make(chan error, 100)
+	var wg sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			session := &Session{Database: setup.Database, catalog: setup.catalog}
+			for round := 1; round <= rounds; round++ {
+				for id := writer; id < numDocs; id += 4 {
+					input := fmt.Sprintf(`updateid things %d {"_id":%d,"a":%d,"b":%d}`, id, id, round, round)
+					if round%10 == 0 {
+						input = fmt.Sprintf("deleteid things %d", id)
+					} else if round%10 == 1 && round > 1 {
+						input = fmt.Sprintf(`insert things {"_id":%d,"a":%d,"b":%d}`, id, round, round)
+					}
+					if _, err := HandleCommand(session, NewCommandFromInput([]byte(input))); err != nil {
+						errs <- errors.New(fmt.Sprintf("%s: %v", input, err))
+						return
+					}
+				}
+			}
+		}(writer)
+	}
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func(reader int) {
+			defer wg.Done()
+			session := &Session{Database: setup.Database, catalog: setup.catalog}
+			for round := 0; round < rounds*2; round++ {
+				err := checkReads(session, (reader+round)%numDocs)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(reader)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func checkReads(session *Session, id int) error {
+	type doc struct {
+		Id int `json:"_id"`
+		A  int `json:"a"`
+		B  int `json:"b"`
+	}
+	check := func(data []byte) error {
+		d := doc{}
+		err := json.Unmarshal(data, &d)
+		if err == nil && d.A != d.B {
+			err = errors.New(fmt.Sprintf("torn document %s", data))
+		}
+		return err
+	}
+
+	response, err := HandleCommand(session, NewCommandFromInput([]byte(fmt.Sprintf("findid things %d", id))))
+	if err == nil {
+		err = check(response)
+	} else if dberror.CodeOf(err) == dberror.NotFound {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, input := range []string{`find things {"filter": {"a": {"$gte": 0}}, "batchSize": 7}`, `findall things {"batchSize": 7}`} {
+		cursor, err := HandleCommand(session, NewCommandFromInput([]byte(input)))
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %v", input, err))
+		}
+		for {
+			response, err := HandleCommand(session, NewCommandFromInput([]byte("getmore "+string(cursor))))
+			if err != nil {
+				return errors.New(fmt.Sprintf("getmore: %v", err))
+			}
+			batch := Batch{}
+			err = json.Unmarshal(response, &batch)
+			if err != nil {
+				return err
+			}
+			for _, data := range batch.Documents {
+				err = check(data)
+				if err != nil {
+					return err
+				}
+			}
+			if !batch.HasMore {
+				break
+			}
+		}
+	}
+	return nil
+}
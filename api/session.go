@@ -0,0 +1,44 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/memory"
+)
+
+// Whatever a connection has set up for itself: the database it's
+// using and any open transaction. Lives as long as the connection does.
+type Session struct {
+	Database string
+	catalog  *memory.Catalog
+	txn      *transaction
+}
+
+func NewSession() (*Session, error) {
+	catalog, err := database.Get(constants.DefaultDatabase)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Database: constants.DefaultDatabase, catalog: catalog}, nil
+}
+
+func use(session *Session, command *Command) ([]byte, error) {
+	if command.Body == nil {
+		return nil, dberror.New(dberror.BadRequest, "use takes a database name as its command body")
+	}
+	catalog, err := database.Get(*command.Body)
+	if err != nil {
+		return nil, err
+	}
+	session.Database = *command.Body
+	session.catalog = catalog
+	return []byte(fmt.Sprintf("switched to database %s", session.Database)), nil
+}
+
+func listDatabases(session *Session, command *Command) ([]byte, error) {
+	return []byte(strings.Join(database.Names(), "\n")), nil
+}
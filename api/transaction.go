@@ -0,0 +1,82 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/memory"
+)
+
+// Between begin and commit a session's inserts, updates and deletes
+// are queued up instead of applied. Commit applies them all as one
+// group, so they either all happen or, if any of them can't, none do,
+// and a crash partway through leaves nothing behind. Reads inside a
+// transaction see what's committed, not the transaction's own writes.
+// A transaction can only write to one collection, since each
+// collection has its own write-ahead log.
+
+type transaction struct {
+	coll   *memory.Collection
+	writes []memory.Write
+}
+
+func (txn *transaction) add(coll *memory.Collection, write memory.Write) error {
+	if txn.coll == nil {
+		txn.coll = coll
+	} else if txn.coll != coll {
+		return dberror.New(dberror.BadRequest, fmt.Sprintf("A transaction can only write to one collection, this one is writing to %s", txn.coll.Name))
+	}
+	txn.writes = append(txn.writes, write)
+	return nil
+}
+
+// Queue the write if the session is in a transaction, otherwise apply it now
+func applyWrite(session *Session, coll *memory.Collection, write memory.Write) ([]byte, error) {
+	if session.txn != nil {
+		err := session.txn.add(coll, write)
+		if err != nil {
+			return nil, err
+		}
+		return []byte("OK, queued"), nil
+	}
+
+	err := coll.ApplyWrites([]memory.Write{write})
+	if err != nil {
+		return nil, err
+	}
+	return []byte("OK"), nil
+}
+
+func begin(session *Session, command *Command) ([]byte, error) {
+	if session.txn != nil {
+		return nil, dberror.New(dberror.BadRequest, "A transaction is already open, commit or abort it first")
+	}
+	session.txn = &transaction{}
+	return []byte("OK"), nil
+}
+
+// The transaction is over either way, if it fails nothing was applied
+func commit(session *Session, command *Command) ([]byte, error) {
+	txn := session.txn
+	if txn == nil {
+		return nil, dberror.New(dberror.BadRequest, "No transaction is open")
+	}
+	session.txn = nil
+	if len(txn.writes) == 0 {
+		return []byte("OK, committed 0 writes"), nil
+	}
+
+	err := txn.coll.ApplyWrites(txn.writes)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("OK, committed %d writes", len(txn.writes))), nil
+}
+
+func abort(session *Session, command *Command) ([]byte, error) {
+	if session.txn == nil {
+		return nil, dberror.New(dberror.BadRequest, "No transaction is open")
+	}
+	session.txn = nil
+	return []byte("OK"), nil
+}
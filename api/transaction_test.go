@@ -0,0 +1,66 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/gamechanger/gcdb/dberror"
+)
+
+func TestCommittedWritesAppearTogether(t *testing.T) {
+	session := newTestSession(t)
+	other := newTestSession(t)
+	run(t, session, `insert things {"_id":1,"n":1}`)
+
+	run(t, session, "begin")
+	run(t, session, `insert things {"_id":2}`)
+	run(t, session, `updateid things 1 {"_id":1,"n":100}`)
+	run(t, session, "deleteid things 1")
+	// Nobody sees any of it until the commit, the session included
+	expectNotFound(t, session, "things", 2)
+	expectFound(t, other, "things", 1)
+
+	if response := run(t, session, "commit"); response != "OK, committed 3 writes" {
+		t.Fatalf("commit said %s", response)
+	}
+	expectFound(t, other, "things", 2)
+	expectNotFound(t, other, "things", 1)
+}
+
+func TestFailedCommitAppliesNothing(t *testing.T) {
+	session := newTestSession(t)
+	run(t, session, `insert things {"_id":1}`)
+
+	run(t, session, "begin")
+	run(t, session, `insert things {"_id":2}`)
+	run(t, session, "deleteid things 1")
+	run(t, session, `insert things {"_id":2}`)
+	runFailing(t, session, "commit", dberror.DuplicateKey)
+	expectFound(t, session, "things", 1)
+	expectNotFound(t, session, "things", 2)
+
+	// The transaction is over either way
+	runFailing(t, session, "commit", dberror.BadRequest)
+	run(t, session, `insert things {"_id":2}`)
+	expectFound(t, session, "things", 2)
+}
+
+func TestAbortDropsQueuedWrites(t *testing.T) {
+	session := newTestSession(t)
+	run(t, session, `insert things {"_id":1}`)
+	run(t, session, "begin")
+	runFailing(t, session, "begin", dberror.BadRequest)
+	run(t, session, "deleteid things 1")
+	run(t, session, `insert things {"_id":2}`)
+	run(t, session, "abort")
+	expectFound(t, session, "things", 1)
+	expectNotFound(t, session, "things", 2)
+}
+
+func TestTransactionStaysInOneCollection(t *testing.T) {
+	session := newTestSession(t)
+	run(t, session, "begin")
+	run(t, session, `insert things {"_id":1}`)
+	runFailing(t, session, `insert others {"_id":1}`, dberror.BadRequest)
+	run(t, session, "commit")
+	expectFound(t, session, "things", 1)
+}
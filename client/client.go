@@ -0,0 +1,410 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/protocol"
+)
+
+// A client for gcdb's binary protocol. It keeps a pool of
+// connections and is safe to share between goroutines.
+
+const (
+	DefaultAddr     = "localhost:19999"
+	DefaultMaxConns = 4
+)
+
+type Config struct {
+	Addr     string // defaults to DefaultAddr
+	MaxConns int    // defaults to DefaultMaxConns
+	// Every connection switches to this database when it's
+	// opened, leave it empty for the server's default
+	Database string
+}
+
+type Client struct {
+	config Config
+	idle   chan *conn
+	// Holds a token for every open connection, idle or not
+	slots  chan bool
+	lock   sync.Mutex
+	closed bool
+}
+
+type conn struct {
+	netConn net.Conn
+	nextId  uint32
+}
+
+func New(config Config) *Client {
+	if config.Addr == "" {
+		config.Addr = DefaultAddr
+	}
+	if config.MaxConns <= 0 {
+		config.MaxConns = DefaultMaxConns
+	}
+	return &Client{
+		config: config,
+		idle:   make(chan *conn, config.MaxConns),
+		slots:  make(chan bool, config.MaxConns),
+	}
+}
+
+// Close every idle connection. Connections in use are
+// closed when they're handed back.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.netConn.Close()
+			<-c.slots
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// Take an idle connection, open a new one if we're under the
+// limit, or wait for one to be handed back
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	if c.isClosed() {
+		return nil, errors.New("gcdb client is closed")
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	case c.slots <- true:
+		cn, err := c.dial(ctx)
+		if err != nil {
+			<-c.slots
+			return nil, err
+		}
+		return cn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Connections that failed mid-request may have a reply
+// still on its way, so they can't be reused
+func (c *Client) put(cn *conn, broken bool) {
+	if broken || c.isClosed() {
+		cn.netConn.Close()
+		<-c.slots
+		return
+	}
+	c.idle <- cn
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := &net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{netConn: netConn}
+	stop := cn.watch(ctx)
+	err = protocol.Negotiate(netConn)
+	stop()
+	if err == nil && c.config.Database != "" {
+		_, err = cn.roundTrip(ctx, protocol.OpUse, []byte(c.config.Database))
+	}
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return cn, nil
+}
+
+// Honor the context's deadline, and cut the connection off
+// if it's cancelled. Call the returned func once done.
+func (cn *conn) watch(ctx context.Context) func() {
+	deadline, _ := ctx.Deadline()
+	cn.netConn.SetDeadline(deadline)
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cn.netConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func (cn *conn) roundTrip(ctx context.Context, opcode protocol.Opcode, body []byte) ([]byte, error) {
+	stop := cn.watch(ctx)
+	defer stop()
+
+	cn.nextId++
+	request := &protocol.Request{Id: cn.nextId, Opcode: opcode, Body: body}
+	err := protocol.WriteRequest(cn.netConn, request)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := protocol.ReadReply(cn.netConn)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Id != request.Id {
+		return nil, errors.New(fmt.Sprintf("Got a reply to request %d while waiting on %d", reply.Id, request.Id))
+	}
+	if reply.Status != protocol.StatusOK {
+		return nil, errorFromReply(reply)
+	}
+	return reply.Body, nil
+}
+
+// Run one command on a pooled connection
+func (c *Client) do(ctx context.Context, opcode protocol.Opcode, body string) ([]byte, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response, err := cn.roundTrip(ctx, opcode, []byte(body))
+	if err != nil {
+		if _, ok := err.(*dberror.Error); ok {
+			c.put(cn, false)
+			return nil, err
+		}
+		c.put(cn, true)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	c.put(cn, false)
+	return response, nil
+}
+
+// Insert a document, which must marshal to a JSON object with an
+// integer _id. The collection is created if it doesn't exist.
+func (c *Client) Insert(ctx context.Context, collection string, doc interface{}) error {
+	body, err := insertBody(collection, doc)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, protocol.OpInsert, body)
+	return err
+}
+
+func insertBody(collection string, doc interface{}) (string, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return collection + " " + string(data), nil
+}
+
+// Unmarshal the document with the given _id into out
+func (c *Client) FindId(ctx context.Context, collection string, id int, out interface{}) error {
+	response, err := c.do(ctx, protocol.OpFindId, collection+" "+strconv.Itoa(id))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(response, out)
+}
+
+// Like FindId, but the document as it was at the given op version
+func (c *Client) FindIdAsOf(ctx context.Context, collection string, id int, version uint64, out interface{}) error {
+	response, err := c.do(ctx, protocol.OpFindId, fmt.Sprintf("%s %d asof %d", collection, id, version))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(response, out)
+}
+
+// Replace the document with the given _id, which must already exist
+func (c *Client) UpdateId(ctx context.Context, collection string, id int, doc interface{}) error {
+	body, err := updateBody(collection, id, doc)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, protocol.OpUpdateId, body)
+	return err
+}
+
+func updateBody(collection string, id int, doc interface{}) (string, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d %s", collection, id, data), nil
+}
+
+func (c *Client) DeleteId(ctx context.Context, collection string, id int) error {
+	_, err := c.do(ctx, protocol.OpDeleteId, collection+" "+strconv.Itoa(id))
+	return err
+}
+
+type InsertManyResult struct {
+	Inserted int           `json:"inserted"`
+	Errors   []InsertError `json:"errors"`
+}
+
+// Why the document at Index in the slice passed to InsertMany didn't go in
+type InsertError struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Insert every document in one round trip. Ordered stops at the first
+// one that can't be inserted, otherwise every one of them is tried.
+// Documents that fail don't make this return an error, look at the
+// result's Errors for those.
+func (c *Client) InsertMany(ctx context.Context, collection string, docs []interface{}, ordered bool) (*InsertManyResult, error) {
+	data, err := json.Marshal(map[string]interface{}{"documents": docs, "ordered": ordered})
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.do(ctx, protocol.OpInsertMany, collection+" "+string(data))
+	if err != nil {
+		return nil, err
+	}
+	result := &InsertManyResult{}
+	err = json.Unmarshal(response, result)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Server sent back a bad insertmany result: %v", err))
+	}
+	return result, nil
+}
+
+// Limits on what one getmore brings back, zero leaves it to the server
+type BatchOptions struct {
+	BatchSize int `json:"batchSize,omitempty"`
+	MaxBytes  int `json:"maxBytes,omitempty"`
+}
+
+func (o BatchOptions) body() string {
+	if o.BatchSize == 0 && o.MaxBytes == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(o)
+	return " " + string(data)
+}
+
+// Open a cursor over every document in the collection, with
+// options applying to every batch unless GetMore overrides them
+func (c *Client) FindAll(ctx context.Context, collection string, options BatchOptions) (*Cursor, error) {
+	response, err := c.do(ctx, protocol.OpFindAll, collection+options.body())
+	if err != nil {
+		return nil, err
+	}
+	cursorId, err := strconv.Atoi(string(response))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Server sent back a bad cursor id %q", response))
+	}
+	return &Cursor{client: c, Id: cursorId}, nil
+}
+
+type Batch struct {
+	Cursor    int               `json:"cursor"`
+	Documents []json.RawMessage `json:"documents"`
+	// Once this is false the server has freed the cursor
+	HasMore bool `json:"hasMore"`
+}
+
+// Fetch the next batch of documents from a cursor. Most callers
+// want a Cursor instead, which does this for them.
+func (c *Client) GetMore(ctx context.Context, cursorId int, options BatchOptions) (*Batch, error) {
+	response, err := c.do(ctx, protocol.OpGetMore, strconv.Itoa(cursorId)+options.body())
+	if err != nil {
+		return nil, err
+	}
+	batch := &Batch{}
+	err = json.Unmarshal(response, batch)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Server sent back a bad batch: %v", err))
+	}
+	return batch, nil
+}
+
+// Free a cursor on the server before it's exhausted
+func (c *Client) KillCursor(ctx context.Context, cursorId int) error {
+	_, err := c.do(ctx, protocol.OpKillCursor, strconv.Itoa(cursorId))
+	return err
+}
+
+type Stats struct {
+	Collection       string
+	Documents        int
+	DataFiles        int
+	ReclaimableBytes uint64
+	// The op version the collection is at, and the oldest
+	// one FindIdAsOf can still read
+	Version            uint64
+	HistoryFromVersion uint64
+	// Entries in each secondary index, by path
+	Indexes map[string]int
+}
+
+func (c *Client) Stats(ctx context.Context, collection string) (*Stats, error) {
+	response, err := c.do(ctx, protocol.OpStats, collection)
+	if err != nil {
+		return nil, err
+	}
+	return parseStats(string(response))
+}
+
+func parseStats(response string) (*Stats, error) {
+	stats := &Stats{Indexes: make(map[string]int)}
+	for _, line := range strings.Split(response, "\n") {
+		pieces := strings.SplitN(line, ": ", 2)
+		if len(pieces) != 2 {
+			continue
+		}
+		key, value := pieces[0], pieces[1]
+		var err error
+		switch {
+		case key == "Collection":
+			stats.Collection = value
+		case key == "Documents":
+			stats.Documents, err = strconv.Atoi(value)
+		case key == "Data files":
+			stats.DataFiles, err = strconv.Atoi(value)
+		case key == "Reclaimable bytes":
+			stats.ReclaimableBytes, err = strconv.ParseUint(value, 10, 64)
+		case key == "Version":
+			stats.Version, err = strconv.ParseUint(value, 10, 64)
+		case key == "History from version":
+			stats.HistoryFromVersion, err = strconv.ParseUint(value, 10, 64)
+		case strings.HasPrefix(key, "Index "):
+			var entries int
+			entries, err = strconv.Atoi(strings.TrimSuffix(value, " entries"))
+			stats.Indexes[strings.TrimPrefix(key, "Index ")] = entries
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't make sense of stats line %q", line))
+		}
+	}
+	return stats, nil
+}
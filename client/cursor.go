@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Iterates over a server-side cursor, calling getmore whenever
+// it runs out of documents:
+//
+//	for cursor.Next(ctx) {
+//		err := cursor.Decode(&doc)
+//	}
+//	err := cursor.Err()
+type Cursor struct {
+	Id      int
+	client  *Client
+	batch   []json.RawMessage
+	current json.RawMessage
+	// The server has sent its last batch and freed the cursor
+	exhausted bool
+	done      bool
+	err       error
+}
+
+// Move on to the next document, returning false once there
+// are no more or something went wrong, see Err for which
+func (cur *Cursor) Next(ctx context.Context) bool {
+	if cur.done {
+		return false
+	}
+	for len(cur.batch) == 0 {
+		if cur.exhausted {
+			cur.done = true
+			return false
+		}
+		batch, err := cur.client.GetMore(ctx, cur.Id, BatchOptions{})
+		if err != nil {
+			cur.done = true
+			cur.err = err
+			return false
+		}
+		cur.batch = batch.Documents
+		cur.exhausted = !batch.HasMore
+	}
+	cur.current = cur.batch[0]
+	cur.batch = cur.batch[1:]
+	return true
+}
+
+// The raw JSON of the current document
+func (cur *Cursor) Document() json.RawMessage {
+	return cur.current
+}
+
+func (cur *Cursor) Decode(out interface{}) error {
+	return json.Unmarshal(cur.current, out)
+}
+
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// Free the cursor on the server if we stopped before the end of it.
+// The server frees cursors on its own once it sends the last batch.
+func (cur *Cursor) Close(ctx context.Context) error {
+	if cur.done || cur.exhausted {
+		cur.done = true
+		return nil
+	}
+	cur.done = true
+	err := cur.client.KillCursor(ctx, cur.Id)
+	if IsCursorNotFound(err) {
+		return nil
+	}
+	return err
+}
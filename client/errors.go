@@ -0,0 +1,30 @@
+package client
+
+import (
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/protocol"
+)
+
+// Errors the server sends back are returned as *dberror.Error with
+// the code from the reply, anything else (a dropped connection,
+// a timeout) comes through as is
+
+func errorFromReply(reply *protocol.Reply) error {
+	return dberror.New(dberror.Code(reply.Status), string(reply.Body))
+}
+
+func IsNotFound(err error) bool {
+	return dberror.Is(err, dberror.NotFound)
+}
+
+func IsDuplicateKey(err error) bool {
+	return dberror.Is(err, dberror.DuplicateKey)
+}
+
+func IsBadRequest(err error) bool {
+	return dberror.Is(err, dberror.BadRequest)
+}
+
+func IsCursorNotFound(err error) bool {
+	return dberror.Is(err, dberror.CursorNotFound)
+}
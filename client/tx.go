@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/protocol"
+)
+
+// A transaction holds on to one of the client's connections from
+// Begin until Commit or Abort, since the server ties it to the
+// connection. Writes are queued on the server and applied together
+// at Commit, which fails without applying any of them if one can't
+// go through. Every write must be to the same collection.
+//
+//	tx, err := c.Begin(ctx)
+//	err = tx.UpdateId(ctx, "accounts", 1, from)
+//	err = tx.UpdateId(ctx, "accounts", 2, to)
+//	err = tx.Commit(ctx)
+type Tx struct {
+	client *Client
+	cn     *conn
+}
+
+func (c *Client) Begin(ctx context.Context) (*Tx, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx := &Tx{client: c, cn: cn}
+	_, err = tx.do(ctx, protocol.OpBegin, "")
+	if err != nil {
+		tx.release(err)
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (tx *Tx) do(ctx context.Context, opcode protocol.Opcode, body string) ([]byte, error) {
+	if tx.cn == nil {
+		return nil, errors.New("Transaction is already over")
+	}
+	response, err := tx.cn.roundTrip(ctx, opcode, []byte(body))
+	if err != nil {
+		if _, ok := err.(*dberror.Error); !ok {
+			// The connection can't be trusted, and closing it
+			// throws away the transaction on the server too
+			tx.release(err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+// Give the connection back, closing it if err means it's broken
+func (tx *Tx) release(err error) {
+	if tx.cn == nil {
+		return
+	}
+	_, serverError := err.(*dberror.Error)
+	tx.client.put(tx.cn, err != nil && !serverError)
+	tx.cn = nil
+}
+
+func (tx *Tx) Insert(ctx context.Context, collection string, doc interface{}) error {
+	body, err := insertBody(collection, doc)
+	if err != nil {
+		return err
+	}
+	_, err = tx.do(ctx, protocol.OpInsert, body)
+	return err
+}
+
+func (tx *Tx) UpdateId(ctx context.Context, collection string, id int, doc interface{}) error {
+	body, err := updateBody(collection, id, doc)
+	if err != nil {
+		return err
+	}
+	_, err = tx.do(ctx, protocol.OpUpdateId, body)
+	return err
+}
+
+func (tx *Tx) DeleteId(ctx context.Context, collection string, id int) error {
+	_, err := tx.do(ctx, protocol.OpDeleteId, collection+" "+strconv.Itoa(id))
+	return err
+}
+
+// Apply every queued write. The transaction is over either way.
+func (tx *Tx) Commit(ctx context.Context) error {
+	_, err := tx.do(ctx, protocol.OpCommit, "")
+	tx.release(err)
+	return err
+}
+
+// Throw the queued writes away. Calling it after Commit does nothing,
+// so it's safe to defer.
+func (tx *Tx) Abort(ctx context.Context) error {
+	if tx.cn == nil {
+		return nil
+	}
+	_, err := tx.do(ctx, protocol.OpAbort, "")
+	tx.release(err)
+	return err
+}
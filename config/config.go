@@ -0,0 +1,170 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+// Server settings come from, in increasing order of precedence:
+// the defaults in constants, a JSON file named by -config or
+// GCDB_CONFIG, GCDB_* environment variables, and command-line flags.
+
+type Config struct {
+	ListenAddr           string `json:"listenAddr"`
+	HTTPListenAddr       string `json:"httpListenAddr"`
+	DataDir              string `json:"dataDir"`
+	DataFileSize         int64  `json:"dataFileSize"`
+	GetMoreBatchSize     int    `json:"getMoreBatchSize"`
+	CursorTimeoutSeconds int    `json:"cursorTimeoutSeconds"`
+	FsyncPolicy          string `json:"fsyncPolicy"`
+	FsyncIntervalMillis  int    `json:"fsyncIntervalMillis"`
+	LogLevel             string `json:"logLevel"`
+}
+
+// Locations within a data file are 32 bits
+const maxDataFileSize = 1<<32 - 1
+const minDataFileSize = 4096
+
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	apply func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "GCDB_LISTEN", "address the TCP protocol listens on",
+		func(c *Config, v string) error { c.ListenAddr = v; return nil }},
+	{"http", "GCDB_HTTP", "address the REST gateway listens on, empty to turn it off",
+		func(c *Config, v string) error { c.HTTPListenAddr = v; return nil }},
+	{"datadir", "GCDB_DATA_DIR", "directory holding every database",
+		func(c *Config, v string) error { c.DataDir = v; return nil }},
+	{"filesize", "GCDB_DATA_FILE_SIZE", "size in bytes of each new data file",
+		func(c *Config, v string) (err error) { c.DataFileSize, err = strconv.ParseInt(v, 10, 64); return }},
+	{"pagesize", "GCDB_GETMORE_BATCH_SIZE", "documents returned by each getmore",
+		func(c *Config, v string) (err error) { c.GetMoreBatchSize, err = strconv.Atoi(v); return }},
+	{"cursor-timeout", "GCDB_CURSOR_TIMEOUT", "seconds an idle cursor lives before it's freed",
+		func(c *Config, v string) (err error) { c.CursorTimeoutSeconds, err = strconv.Atoi(v); return }},
+	{"fsync", "GCDB_FSYNC", "when to fsync the write-ahead log: always, interval or never",
+		func(c *Config, v string) error { c.FsyncPolicy = v; return nil }},
+	{"fsync-interval", "GCDB_FSYNC_INTERVAL_MS", "milliseconds between fsyncs with -fsync interval",
+		func(c *Config, v string) (err error) { c.FsyncIntervalMillis, err = strconv.Atoi(v); return }},
+	{"loglevel", "GCDB_LOG_LEVEL", "debug, info or error",
+		func(c *Config, v string) error { c.LogLevel = v; return nil }},
+}
+
+func Defaults() *Config {
+	return &Config{
+		ListenAddr:           constants.ListenAddr,
+		HTTPListenAddr:       constants.HTTPListenAddr,
+		DataDir:              constants.DataDir,
+		DataFileSize:         constants.DataFileSize,
+		GetMoreBatchSize:     constants.GetMoreBatchSize,
+		CursorTimeoutSeconds: constants.CursorTimeoutSeconds,
+		FsyncPolicy:          constants.WALSyncPolicy,
+		FsyncIntervalMillis:  constants.WALSyncIntervalMillis,
+		LogLevel:             constants.LogLevel,
+	}
+}
+
+// Work out the config from the given command-line arguments and the
+// environment. Returns whatever arguments are left after the flags.
+func Load(name string, args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("GCDB_CONFIG"), "JSON config file")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := Defaults()
+	if *configPath != "" {
+		err = c.loadFile(*configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			err = s.apply(c, value)
+			if err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("Bad value for %s: %v", s.env, err))
+			}
+		}
+	}
+	// Only flags that were actually passed, so an unset flag
+	// doesn't clobber the file or environment with ""
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if applyErr := s.apply(c, *flagValues[s.flag]); applyErr != nil {
+					err = errors.New(fmt.Sprintf("Bad value for -%s: %v", s.flag, applyErr))
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), c.validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error reading config file %s: %v", path, err))
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("Listen address can't be empty")
+	}
+	if c.DataDir == "" {
+		return errors.New("Data directory can't be empty")
+	}
+	if c.DataFileSize < minDataFileSize || c.DataFileSize > maxDataFileSize {
+		return errors.New(fmt.Sprintf("Data file size must be between %d and %d bytes", minDataFileSize, int64(maxDataFileSize)))
+	}
+	if c.GetMoreBatchSize <= 0 {
+		return errors.New("getmore batch size must be positive")
+	}
+	if c.CursorTimeoutSeconds <= 0 {
+		return errors.New("Cursor timeout must be positive")
+	}
+	if c.FsyncIntervalMillis <= 0 {
+		return errors.New("fsync interval must be positive")
+	}
+	_, err := c.SyncPolicy()
+	if err != nil {
+		return err
+	}
+	_, err = c.Level()
+	return err
+}
+
+func (c *Config) SyncPolicy() (wal.SyncPolicy, error) {
+	return wal.ParseSyncPolicy(c.FsyncPolicy)
+}
+
+func (c *Config) Level() (logging.Level, error) {
+	return logging.ParseLevel(c.LogLevel)
+}
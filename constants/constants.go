@@ -1,6 +1,44 @@
 package constants
 
+// Defaults for the settings in the config package, the
+// rest can only be changed by recompiling
 const (
+	ListenAddr   = "localhost:19999"
 	DataDir      = "/var/gcdb"
 	DataFileSize = 1024 * 1024 * 1024 * 2
+	LogLevel     = "info"
+
+	// How many documents each getmore hands back
+	GetMoreBatchSize = 20
+
+	// Cursors nobody has called getmore on in this long get freed
+	CursorTimeoutSeconds = 600
+
+	// Every connection starts out using this database
+	DefaultDatabase = "default"
+	// Where the single collection from before there were
+	// named collections ends up, in the default database
+	LegacyCollection = "default"
+
+	// Where the REST gateway listens, leave empty to turn it off
+	HTTPListenAddr = ""
+
+	// How long shutdown waits for running commands before giving up
+	ShutdownTimeoutSeconds = 30
+
+	// Background compaction kicks in once this fraction
+	// of the data files is taken up by dead records
+	CompactionCheckIntervalSeconds = 60
+	CompactionThreshold            = 0.5
+
+	// How often the write-ahead log is fsynced: always, interval or never
+	WALSyncPolicy         = "interval"
+	WALSyncIntervalMillis = 100
+	// Checkpoint once the log grows past this many bytes
+	WALCheckpointBytes = 64 * 1024 * 1024
+
+	// How many writes can wait for the writer before callers block,
+	// and how many it takes on in one pass
+	WriteQueueLength = 1024
+	MaxWriteBatch    = 256
 )
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/gamechanger/gcdb/memory"
+)
+
+// A database is a catalog of collections kept in its own
+// subdirectory of the data directory, so tenants sharing
+// a server never see each other's collections.
+
+var namePattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Guards the map, not what's in the catalogs. This is separate from
+// the metadata lock since opening a catalog takes that one.
+var lock = &sync.Mutex{}
+var databases = make(map[string]*memory.Catalog)
+
+// Open every database already on disk, called once at startup
+func OpenAll() error {
+	names, err := filesystem.DatabaseNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !namePattern.MatchString(name) {
+			logging.Infof("Ignoring directory %s in the data directory, it isn't a database", name)
+			continue
+		}
+		_, err := Get(name)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error opening database %s: %v", name, err))
+		}
+	}
+	return nil
+}
+
+// Return the catalog for the named database, creating it if needed
+func Get(name string) (*memory.Catalog, error) {
+	if !namePattern.MatchString(name) {
+		return nil, dberror.New(dberror.BadRequest, fmt.Sprintf("Invalid database name %q, use letters, digits, _ and -", name))
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if catalog, ok := databases[name]; ok {
+		return catalog, nil
+	}
+	catalog, err := memory.OpenCatalog(filesystem.DatabaseDir(name))
+	if err != nil {
+		return nil, err
+	}
+	databases[name] = catalog
+	return catalog, nil
+}
+
+// Checkpoint every collection in every database
+func Flush() error {
+	for _, name := range Names() {
+		lock.Lock()
+		catalog := databases[name]
+		lock.Unlock()
+		err := catalog.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close every database for shutdown, making sure everything
+// written so far is on disk and the data files are unmapped
+func CloseAll() error {
+	lock.Lock()
+	defer lock.Unlock()
+	var firstErr error
+	for name, catalog := range databases {
+		err := catalog.Close()
+		if err != nil && firstErr == nil {
+			firstErr = errors.New(fmt.Sprintf("Error closing database %s: %v", name, err))
+		}
+	}
+	databases = make(map[string]*memory.Catalog)
+	return firstErr
+}
+
+func Names() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,72 @@
+package dberror
+
+// Every error a command can fail with falls into one of these
+// kinds. The codes are what clients see, over the binary protocol
+// as the reply status and at the prompt and over HTTP by name, so
+// never renumber or rename them.
+
+type Code byte
+
+const (
+	// Zero is the binary protocol's OK status
+	NotFound Code = iota + 1
+	DuplicateKey
+	BadRequest
+	CursorNotFound
+	// No longer sent now that getmore says when there's nothing
+	// left, but the number stays taken
+	CursorExhausted
+	Internal
+)
+
+var codeNames = map[Code]string{
+	NotFound:        "NotFound",
+	DuplicateKey:    "DuplicateKey",
+	BadRequest:      "BadRequest",
+	CursorNotFound:  "CursorNotFound",
+	CursorExhausted: "CursorExhausted",
+	Internal:        "Internal",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func New(code Code, message string) error {
+	return &Error{Code: code, Message: message}
+}
+
+// Give an error a code unless it already has one
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// Anything we didn't see coming is our fault
+func CodeOf(err error) Code {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return Internal
+}
+
+func Is(err error, code Code) bool {
+	return err != nil && CodeOf(err) == code
+}
@@ -1,22 +1,124 @@
 package filesystem
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/logging"
 )
 
-func EnsureCurrentDataFile() (*os.File, error) {
-	path, err := latestDataFilePath()
+const (
+	compactionDirName    = "compacting"
+	compactionMarkerName = "COMPLETE"
+	lockFileName         = "LOCK"
+)
+
+var dataDir = constants.DataDir
+var dataFileSize int64 = constants.DataFileSize
+
+// Held open for as long as we have the data directory locked
+var lockFile *os.File
+
+// Both must be set before any data files are opened
+func SetDataDir(dir string) {
+	dataDir = dir
+}
+
+func SetDataFileSize(size int64) {
+	dataFileSize = size
+}
+
+// Only one process at a time gets to use a data directory, be it the
+// server or one of the tools. The lock goes with the process however
+// it exits, so there's nothing to clean up after a crash.
+func LockDataDir() error {
+	err := EnsureDir(dataDir)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dataDir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return errors.New(fmt.Sprintf("Data directory %s is in use by another gcdb process", dataDir))
+		}
+		return err
+	}
+	lockFile = file
+	return nil
+}
+
+func UnlockDataDir() error {
+	if lockFile == nil {
+		return nil
+	}
+	err := lockFile.Close()
+	lockFile = nil
+	return err
+}
+
+// Each database is a subdirectory of the data directory
+func DatabaseDir(name string) string {
+	return filepath.Join(dataDir, name)
+}
+
+func DatabaseNames() ([]string, error) {
+	err := EnsureDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return CollectionNames(dataDir)
+}
+
+// Every collection keeps its data files, write-ahead log and index
+// files in its own subdirectory of its database's directory
+func CollectionDir(parent, name string) string {
+	return filepath.Join(parent, name)
+}
+
+func EnsureDir(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+func RemoveDir(dir string) error {
+	return os.RemoveAll(dir)
+}
+
+// Return the names of every directory under parent, sorted
+func CollectionNames(parent string) ([]string, error) {
+	files, err := ioutil.ReadDir(parent)
 	if err != nil {
 		return nil, err
 	}
+	names := make([]string, 0)
+	for _, file := range files {
+		if file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Open the data file with the given number, creating it and
+// expanding it to its full size if it does not exist yet
+func EnsureDataFile(dir string, fileNum int) (*os.File, error) {
+	return EnsureDataFileAtPath(DataFilePath(dir, fileNum))
+}
+
+func EnsureDataFileAtPath(path string) (*os.File, error) {
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
@@ -28,8 +130,8 @@ func EnsureCurrentDataFile() (*os.File, error) {
 	}
 
 	if fileInfo.Size() == 0 {
-		log.Printf("Expanding data file %s to initial size %d", path, constants.DataFileSize)
-		err = file.Truncate(constants.DataFileSize)
+		logging.Infof("Expanding data file %s to initial size %d", path, dataFileSize)
+		err = file.Truncate(dataFileSize)
 		if err != nil {
 			return nil, err
 		}
@@ -37,29 +139,233 @@ func EnsureCurrentDataFile() (*os.File, error) {
 	return file, nil
 }
 
-// Return the file path of the latest created data file,
-// or the path for an initial data.0 file if none have
-// yet been created
-func latestDataFilePath() (string, error) {
-	files, err := ioutil.ReadDir(constants.DataDir)
+func OpenDataFileReadOnly(dir string, fileNum int) (*os.File, error) {
+	return os.Open(DataFilePath(dir, fileNum))
+}
+
+func DataFilePath(dir string, fileNum int) string {
+	return filepath.Join(dir, fmt.Sprintf("data.%d", fileNum))
+}
+
+func WALPath(dir string) string {
+	return filepath.Join(dir, "wal.log")
+}
+
+func IdIndexCheckpointPath(dir string) string {
+	return filepath.Join(dir, "id.index")
+}
+
+func SecondaryIndexCheckpointPath(dir string) string {
+	return filepath.Join(dir, "secondary.index")
+}
+
+func IndexDefinitionsPath(dir string) string {
+	return filepath.Join(dir, "indexes.json")
+}
+
+// Holds the oldest op version compaction has kept every record for
+func HorizonPath(dir string) string {
+	return filepath.Join(dir, "horizon")
+}
+
+// Write to a temporary file and rename it into place,
+// so readers only ever see the old contents or the new
+func WriteFileAtomically(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Compaction writes its new data files into a scratch directory
+// and only moves them over the live ones once they are complete
+func CompactionDataFilePath(dir string, fileNum int) string {
+	return filepath.Join(dir, compactionDirName, fmt.Sprintf("data.%d", fileNum))
+}
+
+func BeginCompaction(dir string) error {
+	compactionDir := filepath.Join(dir, compactionDirName)
+	err := os.RemoveAll(compactionDir)
 	if err != nil {
-		return "", err
+		return err
 	}
-	var latest *int
+	return os.Mkdir(compactionDir, 0700)
+}
+
+func AbandonCompaction(dir string) error {
+	return os.RemoveAll(filepath.Join(dir, compactionDirName))
+}
+
+// Record that the compacted files are complete. Once this returns the
+// compaction has happened as far as a restart is concerned, and if we
+// go down before FinishCompaction is done RecoverCompaction finishes
+// it on the next startup. Nothing of the original files is touched
+// until then.
+func CommitCompaction(dir string, numFiles int) error {
+	compactionDir := filepath.Join(dir, compactionDirName)
+	err := writeFileSynced(filepath.Join(compactionDir, compactionMarkerName), []byte(strconv.Itoa(numFiles)))
+	if err != nil {
+		return err
+	}
+	// The new files and the marker are no use if their names are lost
+	err = syncDir(compactionDir)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Swap the compacted data files in for the live ones
+func FinishCompaction(dir string) error {
+	return moveCompactedFiles(dir)
+}
+
+// Whether a compaction got as far as swapping files before we went
+// down, leaving RecoverCompaction to finish it at the next startup
+func CompactionInterrupted(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, compactionDirName, compactionMarkerName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Called at startup before any data files are opened
+func RecoverCompaction(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, compactionDirName, compactionMarkerName)); err != nil {
+		if os.IsNotExist(err) {
+			return AbandonCompaction(dir)
+		}
+		return err
+	}
+	if _, err := readCompactionMarker(dir); err != nil {
+		// We went down writing the marker, so none of the
+		// original files have been touched yet
+		logging.Infof("Abandoning compaction in %s with an unreadable marker: %v", dir, err)
+		return AbandonCompaction(dir)
+	}
+	logging.Infoln("Finishing interrupted compaction")
+	return moveCompactedFiles(dir)
+}
+
+func readCompactionMarker(dir string) (int, error) {
+	markerBytes, err := ioutil.ReadFile(filepath.Join(dir, compactionDirName, compactionMarkerName))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(markerBytes))
+}
+
+// Each compacted file is renamed over its live counterpart, so this
+// is safe to run again if we crash in the middle of it
+func moveCompactedFiles(dir string) error {
+	numFiles, err := readCompactionMarker(dir)
+	if err != nil {
+		return err
+	}
+	for fileNum := 0; fileNum < numFiles; fileNum++ {
+		compactedPath := CompactionDataFilePath(dir, fileNum)
+		if _, err := os.Stat(compactedPath); os.IsNotExist(err) {
+			continue
+		}
+		err = os.Rename(compactedPath, DataFilePath(dir, fileNum))
+		if err != nil {
+			return err
+		}
+	}
+	// Make sure the renames stick before any original goes for good
+	err = syncDir(dir)
+	if err != nil {
+		return err
+	}
+	nums, err := DataFileNumbers(dir)
+	if err != nil {
+		return err
+	}
+	for _, fileNum := range nums {
+		if fileNum >= numFiles {
+			err = os.Remove(DataFilePath(dir, fileNum))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = os.RemoveAll(filepath.Join(dir, compactionDirName))
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Creating, renaming and removing files only gets to disk
+// once the directory they're in has been synced
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Return the numbers of every data file on disk in ascending
+// order, or just the number for an initial data.0 file if none
+// have yet been created. The numbers must be contiguous from 0.
+func DataFileNumbers(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	nums := make([]int, 0)
 	for idx := range files {
 		if strings.HasPrefix(files[idx].Name(), "data.") {
 			pieces := strings.Split(files[idx].Name(), ".")
 			fileNum, err := strconv.Atoi(pieces[1])
 			if err != nil {
-				return "", err
-			}
-			if latest == nil || fileNum > *latest {
-				latest = &fileNum
+				return nil, err
 			}
+			nums = append(nums, fileNum)
 		}
 	}
-	if latest == nil {
-		return filepath.Join(constants.DataDir, "data.0"), nil
+	if len(nums) == 0 {
+		return []int{0}, nil
+	}
+	sort.Ints(nums)
+	for idx := range nums {
+		if nums[idx] != idx {
+			return nil, errors.New(fmt.Sprintf("Data file data.%d is missing from %s", idx, dir))
+		}
 	}
-	return filepath.Join(constants.DataDir, fmt.Sprintf("data.%d", *latest)), nil
+	return nums, nil
 }
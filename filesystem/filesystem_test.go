@@ -0,0 +1,30 @@
+package filesystem
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDataDirCanOnlyBeLockedOnce(t *testing.T) {
+	useTestDataDir(t)
+	err := LockDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnlockDataDir()
+
+	// Same as another process trying, flock locks belong to the open file
+	err = LockDataDir()
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("locked a data directory twice: %v", err)
+	}
+
+	err = UnlockDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LockDataDir()
+	if err != nil {
+		t.Fatalf("couldn't lock again after unlocking: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gamechanger/gcdb/logging"
+)
+
+// Collections get gathered here on their way into a database, so a
+// crash part way through a migration picks up where it left off
+// instead of leaving a collection's files split between two places
+const migrationDirName = ".migrating"
+
+// Older releases kept collections elsewhere in the data directory.
+// Before named collections the one collection's files sat in the data
+// directory itself, and before databases each collection had its own
+// subdirectory of it. Move them all into the named database, the lone
+// collection going by collName, where they'd be now. Must be called
+// before any database is opened.
+func MigrateLegacyLayout(dbName, collName string) error {
+	err := EnsureDir(dataDir)
+	if err != nil {
+		return err
+	}
+	staging := filepath.Join(dataDir, migrationDirName)
+	legacyFiles, err := legacyCollectionFiles(dataDir)
+	if err != nil {
+		return err
+	}
+	legacyDirs, err := legacyCollectionDirs(dataDir, len(legacyFiles) > 0)
+	if err != nil {
+		return err
+	}
+
+	// Check everything can go where it's headed before moving any of it
+	dbDir := DatabaseDir(dbName)
+	headedFor := make(map[string]string)
+	if len(legacyFiles) > 0 {
+		headedFor[collName] = dataDir
+	}
+	for _, name := range legacyDirs {
+		if from, ok := headedFor[name]; ok {
+			return errors.New(fmt.Sprintf("Can't move both %s and %s to collection %s", from, filepath.Join(dataDir, name), name))
+		}
+		headedFor[name] = filepath.Join(dataDir, name)
+	}
+	if _, ok := headedFor[dbName]; !ok {
+		// Otherwise the database directory is one of the collections
+		// that's moving, and it's empty once that's out of the way
+		for name, from := range headedFor {
+			target := CollectionDir(dbDir, name)
+			if exists(target) {
+				return errors.New(fmt.Sprintf("Can't move the collection in %s to %s, there's already one there", from, target))
+			}
+		}
+	}
+
+	if len(legacyFiles) > 0 {
+		logging.Infof("Moving the collection in %s to collection %s in database %s", dataDir, collName, dbName)
+		err = stageFiles(dataDir, legacyFiles, filepath.Join(staging, collName))
+		if err != nil {
+			return err
+		}
+	}
+	if len(legacyDirs) > 0 {
+		err = stageDirs(dataDir, legacyDirs, staging)
+		if err != nil {
+			return err
+		}
+	}
+	if !exists(staging) {
+		return nil
+	}
+	return finishMigration(staging, dbName)
+}
+
+// Where an older release left collections, for tools that have to
+// leave the data directory as it is. Returns the directories holding
+// each collection MigrateLegacyLayout would move, and the names of the
+// subdirectories of the data directory that belong to those collections
+// rather than being databases.
+func FindLegacyLayout() ([]string, []string, error) {
+	collDirs := make([]string, 0)
+	notDatabases := make([]string, 0)
+	legacyFiles, err := legacyCollectionFiles(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(legacyFiles) > 0 {
+		collDirs = append(collDirs, dataDir)
+		if exists(filepath.Join(dataDir, compactionDirName)) {
+			notDatabases = append(notDatabases, compactionDirName)
+		}
+	}
+	legacyDirs, err := legacyCollectionDirs(dataDir, len(legacyFiles) > 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range legacyDirs {
+		collDirs = append(collDirs, filepath.Join(dataDir, name))
+		notDatabases = append(notDatabases, name)
+	}
+	staging := filepath.Join(dataDir, migrationDirName)
+	if exists(staging) {
+		staged, err := CollectionNames(staging)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range staged {
+			collDirs = append(collDirs, filepath.Join(staging, name))
+		}
+		notDatabases = append(notDatabases, migrationDirName)
+	}
+	return collDirs, notDatabases, nil
+}
+
+// Whether name is something a collection keeps in its directory,
+// or a temporary file on its way to becoming one
+func isCollectionFile(name string) bool {
+	switch strings.TrimSuffix(name, ".tmp") {
+	case "wal.log", "id.index", "secondary.index", "indexes.json", "horizon":
+		return true
+	}
+	return strings.HasPrefix(name, "data.")
+}
+
+// The checkpoints have changed layout since, the indexes
+// get rebuilt from the data files instead
+func isIndexCheckpoint(name string) bool {
+	switch strings.TrimSuffix(name, ".tmp") {
+	case "id.index", "secondary.index":
+		return true
+	}
+	return false
+}
+
+// The names of the collection files kept directly in dir, along with
+// any compaction they were in the middle of
+func legacyCollectionFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, file := range files {
+		if file.Mode().IsRegular() && isCollectionFile(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	// Only a compaction if there's a collection for it to belong to,
+	// otherwise it's a database or collection that happens to share the name
+	if len(names) > 0 && exists(filepath.Join(dir, compactionDirName)) {
+		names = append(names, compactionDirName)
+	}
+	return names, nil
+}
+
+// The subdirectories of dir that are collections rather than databases.
+// With withFiles dir holds a collection's files itself, and so its
+// compaction directory is part of that collection.
+func legacyCollectionDirs(dir string, withFiles bool) ([]string, error) {
+	names, err := CollectionNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	legacy := make([]string, 0)
+	for _, name := range names {
+		if name == migrationDirName || (withFiles && name == compactionDirName) {
+			continue
+		}
+		files, err := legacyCollectionFiles(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			legacy = append(legacy, name)
+		}
+	}
+	return legacy, nil
+}
+
+// Move the named files from dir into stagedDir
+func stageFiles(dir string, names []string, stagedDir string) error {
+	err := EnsureDir(stagedDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if isIndexCheckpoint(name) {
+			err = os.Remove(filepath.Join(dir, name))
+		} else {
+			err = os.Rename(filepath.Join(dir, name), filepath.Join(stagedDir, name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, synced := range []string{stagedDir, filepath.Dir(stagedDir), dir} {
+		err = syncDir(synced)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move each of the named subdirectories of dir into staging whole
+func stageDirs(dir string, names []string, staging string) error {
+	err := EnsureDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		logging.Infof("Moving collection %s in %s into a database", name, dir)
+		err = os.Rename(filepath.Join(dir, name), filepath.Join(staging, name))
+		if err != nil {
+			return err
+		}
+	}
+	err = syncDir(staging)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Move every collection in the staging directory into the database
+func finishMigration(staging, dbName string) error {
+	names, err := CollectionNames(staging)
+	if err != nil {
+		return err
+	}
+	dbDir := DatabaseDir(dbName)
+	err = EnsureDir(dbDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		target := CollectionDir(dbDir, name)
+		if exists(target) {
+			return errors.New(fmt.Sprintf("Can't move collection %s into database %s, there's already one there", name, dbName))
+		}
+		err = os.Rename(filepath.Join(staging, name), target)
+		if err != nil {
+			return err
+		}
+	}
+	err = syncDir(dbDir)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(staging)
+	if err != nil {
+		return err
+	}
+	return syncDir(dataDir)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,240 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func useTestDataDir(t *testing.T) string {
+	dir := t.TempDir()
+	SetDataDir(dir)
+	return dir
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	t.Helper()
+	err := EnsureDir(filepath.Dir(path))
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(contents), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Every file under dir as a path relative to it, mapped to its contents
+func treeContents(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		contents[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func expectTree(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	got := treeContents(t, dir)
+	paths := make([]string, 0)
+	for path := range got {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if len(got) != len(want) {
+		t.Fatalf("got files %v, want %v", paths, want)
+	}
+	for path, contents := range want {
+		if got[path] != contents {
+			t.Fatalf("%s holds %q, want %q (files are %v)", path, got[path], contents, paths)
+		}
+	}
+}
+
+func TestLegacyCollectionIsMoved(t *testing.T) {
+	dir := useTestDataDir(t)
+	for _, name := range []string{"data.0", "data.1", "wal.log", "indexes.json", "horizon", "id.index", "compacting/data.0"} {
+		writeTestFile(t, filepath.Join(dir, name), name)
+	}
+	// Somebody else's file stays put
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), "notes")
+
+	err := MigrateLegacyLayout("default", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTree(t, dir, map[string]string{
+		"default/legacy/data.0":            "data.0",
+		"default/legacy/data.1":            "data.1",
+		"default/legacy/wal.log":           "wal.log",
+		"default/legacy/indexes.json":      "indexes.json",
+		"default/legacy/horizon":           "horizon",
+		"default/legacy/compacting/data.0": "compacting/data.0",
+		"notes.txt":                        "notes",
+	})
+
+	// Nothing left to do the second time around
+	err = MigrateLegacyLayout("default", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := DatabaseNames()
+	if err != nil || len(names) != 1 || names[0] != "default" {
+		t.Fatalf("databases %v: %v", names, err)
+	}
+}
+
+func TestInterruptedMigrationIsFinished(t *testing.T) {
+	dir := useTestDataDir(t)
+	// Went down part way through moving the files over
+	writeTestFile(t, filepath.Join(dir, migrationDirName, "legacy", "data.0"), "data.0")
+	writeTestFile(t, filepath.Join(dir, "data.1"), "data.1")
+	writeTestFile(t, filepath.Join(dir, "wal.log"), "wal.log")
+
+	err := MigrateLegacyLayout("default", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTree(t, dir, map[string]string{
+		"default/legacy/data.0":  "data.0",
+		"default/legacy/data.1":  "data.1",
+		"default/legacy/wal.log": "wal.log",
+	})
+	if exists(filepath.Join(dir, migrationDirName)) {
+		t.Fatal("staging directory left behind")
+	}
+}
+
+func TestMigrationRefusesToOverwrite(t *testing.T) {
+	dir := useTestDataDir(t)
+	writeTestFile(t, filepath.Join(dir, "data.0"), "old")
+	writeTestFile(t, filepath.Join(dir, "default", "legacy", "data.0"), "new")
+
+	err := MigrateLegacyLayout("default", "legacy")
+	if err == nil {
+		t.Fatal("migrated over an existing collection")
+	}
+	expectTree(t, dir, map[string]string{
+		"data.0":                "old",
+		"default/legacy/data.0": "new",
+	})
+}
+
+func TestCurrentLayoutIsLeftAlone(t *testing.T) {
+	dir := useTestDataDir(t)
+	writeTestFile(t, filepath.Join(dir, "default", "users", "data.0"), "data.0")
+	// A collection that happens to be called compacting isn't a compaction
+	writeTestFile(t, filepath.Join(dir, "compacting", "users", "data.0"), "data.0")
+
+	err := MigrateLegacyLayout("default", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTree(t, dir, map[string]string{
+		"default/users/data.0":    "data.0",
+		"compacting/users/data.0": "data.0",
+	})
+}
+
+func TestPerCollectionDirectoriesMoveIntoDatabase(t *testing.T) {
+	dir := useTestDataDir(t)
+	writeTestFile(t, filepath.Join(dir, "users", "data.0"), "users")
+	writeTestFile(t, filepath.Join(dir, "users", "compacting", "data.0"), "compacting users")
+	writeTestFile(t, filepath.Join(dir, "teams", "wal.log"), "teams")
+	// A collection that shares the database's name
+	writeTestFile(t, filepath.Join(dir, "default", "data.0"), "default")
+	// Already a database
+	writeTestFile(t, filepath.Join(dir, "tenant", "games", "data.0"), "games")
+
+	err := MigrateLegacyLayout("default", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTree(t, dir, map[string]string{
+		"default/users/data.0":            "users",
+		"default/users/compacting/data.0": "compacting users",
+		"default/teams/wal.log":           "teams",
+		"default/default/data.0":          "default",
+		"tenant/games/data.0":             "games",
+	})
+}
+
+func TestInterruptedDirectoryMigrationIsFinished(t *testing.T) {
+	dir := useTestDataDir(t)
+	writeTestFile(t, filepath.Join(dir, migrationDirName, "users", "data.0"), "users")
+	writeTestFile(t, filepath.Join(dir, "teams", "data.0"), "teams")
+
+	err := MigrateLegacyLayout("default", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTree(t, dir, map[string]string{
+		"default/users/data.0": "users",
+		"default/teams/data.0": "teams",
+	})
+}
+
+func TestMigrationRefusesCollidingCollections(t *testing.T) {
+	dir := useTestDataDir(t)
+	writeTestFile(t, filepath.Join(dir, "data.0"), "lone")
+	writeTestFile(t, filepath.Join(dir, "legacy", "data.0"), "named")
+	writeTestFile(t, filepath.Join(dir, "users", "data.0"), "users")
+
+	err := MigrateLegacyLayout("default", "legacy")
+	if err == nil {
+		t.Fatal("moved two collections to the same place")
+	}
+	expectTree(t, dir, map[string]string{
+		"data.0":        "lone",
+		"legacy/data.0": "named",
+		"users/data.0":  "users",
+	})
+}
+
+func TestFindLegacyLayout(t *testing.T) {
+	dir := useTestDataDir(t)
+	writeTestFile(t, filepath.Join(dir, "data.0"), "lone")
+	writeTestFile(t, filepath.Join(dir, "compacting", "data.0"), "compacting lone")
+	writeTestFile(t, filepath.Join(dir, "users", "data.0"), "users")
+	writeTestFile(t, filepath.Join(dir, migrationDirName, "teams", "data.0"), "teams")
+	writeTestFile(t, filepath.Join(dir, "default", "games", "data.0"), "games")
+	before := treeContents(t, dir)
+
+	collDirs, notDatabases, err := FindLegacyLayout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{dir, filepath.Join(dir, "users"), filepath.Join(dir, migrationDirName, "teams")}
+	if fmt.Sprint(collDirs) != fmt.Sprint(want) {
+		t.Fatalf("found collections in %v, want %v", collDirs, want)
+	}
+	if fmt.Sprint(notDatabases) != fmt.Sprint([]string{"compacting", "users", migrationDirName}) {
+		t.Fatalf("%v aren't databases", notDatabases)
+	}
+	expectTree(t, dir, before)
+
+	// Nothing to find once they've moved
+	err = MigrateLegacyLayout("default", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collDirs, notDatabases, err = FindLegacyLayout()
+	if err != nil || len(collDirs) != 0 || len(notDatabases) != 0 {
+		t.Fatalf("found %v and %v after migrating: %v", collDirs, notDatabases, err)
+	}
+}
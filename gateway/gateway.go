@@ -0,0 +1,251 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gamechanger/gcdb/api"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/logging"
+)
+
+// A REST front end for anyone who'd rather not speak the TCP
+// protocol. Every route turns into an ordinary api command:
+// POST   /docs?collection=c        insert the JSON body
+// GET    /docs/{id}?collection=c   findid
+// PUT    /docs/{id}?collection=c   updateid with the JSON body
+// DELETE /docs/{id}?collection=c   deleteid
+// GET    /docs?collection=c        findall, streamed as NDJSON
+// GET    /docs?cursor=n            the rest of an open cursor, as NDJSON
+// Add db=name to any of them to use a database other than the default.
+// A findall cursor only lives as long as the request streaming it.
+
+// Call ListenAndServe on the result to start it, and
+// Shutdown to stop it once in-flight requests are done
+func NewServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/docs", handleDocs)
+	mux.HandleFunc("/docs/", handleDoc)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// Every request gets a session of its own, there's nothing to carry over
+func newSession(r *http.Request) (*api.Session, error) {
+	session, err := api.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	if db := r.URL.Query().Get("db"); db != "" {
+		_, err = api.HandleCommand(session, api.NewCommand("use", []byte(db)))
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+func run(session *api.Session, name string, args ...string) ([]byte, error) {
+	return api.HandleCommand(session, api.NewCommand(name, []byte(strings.Join(args, " "))))
+}
+
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	session, err := newSession(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer session.Close()
+	collection := r.URL.Query().Get("collection")
+
+	switch r.Method {
+	case "POST":
+		if collection == "" {
+			writeBadRequest(w, "collection is required")
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		_, err := run(session, "insert", collection, body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]bool{"ok": true})
+	case "GET":
+		cursorParam := r.URL.Query().Get("cursor")
+		if cursorParam == "" {
+			if collection == "" {
+				writeBadRequest(w, "either collection or cursor is required")
+				return
+			}
+			response, err := run(session, "findall", collection)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cursorParam = string(response)
+		} else if _, err := strconv.Atoi(cursorParam); err != nil {
+			writeBadRequest(w, "cursor must be an integer")
+			return
+		}
+		streamCursor(w, r, session, cursorParam)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody(dberror.New(dberror.BadRequest, "method not allowed")))
+	}
+}
+
+func handleDoc(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/docs/")
+	if _, err := strconv.Atoi(id); err != nil {
+		writeBadRequest(w, "document id must be an integer")
+		return
+	}
+	collection := r.URL.Query().Get("collection")
+	if collection == "" {
+		writeBadRequest(w, "collection is required")
+		return
+	}
+	session, err := newSession(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer session.Close()
+
+	switch r.Method {
+	case "GET":
+		response, err := run(session, "findid", collection, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	case "PUT":
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		_, err := run(session, "updateid", collection, id, body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	case "DELETE":
+		_, err := run(session, "deleteid", collection, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody(dberror.New(dberror.BadRequest, "method not allowed")))
+	}
+}
+
+// Write one document per line, flushing after every getmore so
+// a client can start on the first batch while we fetch the next
+func streamCursor(w http.ResponseWriter, r *http.Request, session *api.Session, cursorId string) {
+	batch, err := getMore(session, cursorId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Gcdb-Cursor", cursorId)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for {
+		for _, doc := range batch.Documents {
+			_, err = w.Write(append(doc, '\n'))
+			if err != nil {
+				break
+			}
+		}
+		if flusher != nil && err == nil {
+			flusher.Flush()
+		}
+		if err != nil || r.Context().Err() != nil {
+			// The client's gone, no sense reading the rest for nobody
+			logging.Debugf("Stopped streaming cursor %s to a client that went away", cursorId)
+			run(session, "killcursor", cursorId)
+			return
+		}
+		if !batch.HasMore {
+			return
+		}
+		batch, err = getMore(session, cursorId)
+		if err != nil {
+			// Too late for a status code, so the error goes in the stream
+			line, _ := json.Marshal(errorBody(err))
+			w.Write(append(line, '\n'))
+			return
+		}
+	}
+}
+
+func getMore(session *api.Session, cursorId string) (*api.Batch, error) {
+	response, err := run(session, "getmore", cursorId)
+	if err != nil {
+		return nil, err
+	}
+	batch := &api.Batch{}
+	err = json.Unmarshal(response, batch)
+	return batch, err
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeBadRequest(w, "request body must be a JSON document: "+err.Error())
+		return "", false
+	}
+	return string(body), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data = []byte(`{"error":"couldn't encode response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeBadRequest(w http.ResponseWriter, message string) {
+	writeError(w, dberror.New(dberror.BadRequest, message))
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusFor(err), errorBody(err))
+}
+
+func errorBody(err error) map[string]string {
+	return map[string]string{"error": err.Error(), "code": dberror.CodeOf(err).String()}
+}
+
+var codeStatuses = map[dberror.Code]int{
+	dberror.NotFound:       http.StatusNotFound,
+	dberror.DuplicateKey:   http.StatusConflict,
+	dberror.BadRequest:     http.StatusBadRequest,
+	dberror.CursorNotFound: http.StatusNotFound,
+	dberror.Internal:       http.StatusInternalServerError,
+}
+
+func statusFor(err error) int {
+	if status, ok := codeStatuses[dberror.CodeOf(err)]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,273 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gamechanger/gcdb/api"
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gcdb-gateway")
+	if err != nil {
+		panic(err)
+	}
+	filesystem.SetDataDir(dir)
+	filesystem.SetDataFileSize(1 << 16)
+	memory.SetWALSyncPolicy(wal.SyncNever, 0)
+	memory.StartWriter()
+	status := m.Run()
+	database.CloseAll()
+	os.RemoveAll(dir)
+	os.Exit(status)
+}
+
+var unsafeNameChars = regexp.MustCompile("[^A-Za-z0-9_-]")
+
+// Each test gets a database of its own
+func testDatabase(t *testing.T) string {
+	return unsafeNameChars.ReplaceAllString(t.Name(), "_")
+}
+
+func startTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(NewServer("").Handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func docsURL(t *testing.T, server *httptest.Server, path string) string {
+	return fmt.Sprintf("%s/docs%s?db=%s&collection=test", server.URL, path, testDatabase(t))
+}
+
+// Make the request and return the status and body
+func send(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(data)
+}
+
+func expectStatus(t *testing.T, method, url, body string, status int) string {
+	t.Helper()
+	got, response := send(t, method, url, body)
+	if got != status {
+		t.Fatalf("%s %s returned %d with %s, want %d", method, url, got, response, status)
+	}
+	return response
+}
+
+// Expect an error response with the given status and code
+func expectError(t *testing.T, method, url, body string, status int, code dberror.Code) {
+	t.Helper()
+	response := expectStatus(t, method, url, body, status)
+	decoded := make(map[string]string)
+	err := json.Unmarshal([]byte(response), &decoded)
+	if err != nil {
+		t.Fatalf("%s %s: %v in %s", method, url, err, response)
+	}
+	if decoded["code"] != code.String() || decoded["error"] == "" {
+		t.Fatalf("%s %s returned %s, want code %s", method, url, response, code)
+	}
+}
+
+func insertTestDocs(t *testing.T, server *httptest.Server, n int) {
+	t.Helper()
+	for id := 0; id < n; id++ {
+		expectStatus(t, "POST", docsURL(t, server, ""), fmt.Sprintf(`{"_id": %d, "n": %d}`, id, id), http.StatusCreated)
+	}
+}
+
+func openCursors(t *testing.T) string {
+	t.Helper()
+	session, err := api.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	response, err := run(session, "cursors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(response)
+}
+
+func TestCRUD(t *testing.T) {
+	server := startTestServer(t)
+	doc := docsURL(t, server, "/1")
+
+	expectStatus(t, "POST", docsURL(t, server, ""), `{"_id": 1, "n": 1}`, http.StatusCreated)
+	if response := expectStatus(t, "GET", doc, "", http.StatusOK); !strings.Contains(response, `"n":1`) {
+		t.Fatalf("found %s", response)
+	}
+	expectStatus(t, "PUT", doc, `{"_id": 1, "n": 2}`, http.StatusOK)
+	if response := expectStatus(t, "GET", doc, "", http.StatusOK); !strings.Contains(response, `"n":2`) {
+		t.Fatalf("found %s after updating it", response)
+	}
+	expectStatus(t, "DELETE", doc, "", http.StatusNoContent)
+	expectError(t, "GET", doc, "", http.StatusNotFound, dberror.NotFound)
+
+	// Somewhere else entirely without db
+	other := strings.Replace(doc, "db="+testDatabase(t), "db=", 1)
+	expectError(t, "GET", other, "", http.StatusNotFound, dberror.NotFound)
+}
+
+func TestErrorStatuses(t *testing.T) {
+	server := startTestServer(t)
+	insertTestDocs(t, server, 1)
+
+	expectError(t, "POST", docsURL(t, server, ""), `{"_id": 0}`, http.StatusConflict, dberror.DuplicateKey)
+	expectError(t, "POST", docsURL(t, server, ""), `{"_id": `, http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "POST", docsURL(t, server, ""), `{"n": 1}`, http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "PUT", docsURL(t, server, "/0"), `{"_id": 1}`, http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "PUT", docsURL(t, server, "/5"), `{"_id": 5}`, http.StatusNotFound, dberror.NotFound)
+	expectError(t, "DELETE", docsURL(t, server, "/5"), "", http.StatusNotFound, dberror.NotFound)
+	expectError(t, "GET", docsURL(t, server, "/x"), "", http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "GET", server.URL+"/docs/0", "", http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "GET", server.URL+"/docs", "", http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "GET", server.URL+"/docs?db=no.dots&collection=test", "", http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "GET", server.URL+"/docs?cursor=x", "", http.StatusBadRequest, dberror.BadRequest)
+	expectError(t, "GET", server.URL+"/docs?cursor=999999", "", http.StatusNotFound, dberror.CursorNotFound)
+	expectError(t, "PATCH", docsURL(t, server, ""), "", http.StatusMethodNotAllowed, dberror.BadRequest)
+	expectError(t, "POST", docsURL(t, server, "/0"), "", http.StatusMethodNotAllowed, dberror.BadRequest)
+
+	// Anything without a code is our fault
+	if status := statusFor(errors.New("surprise")); status != http.StatusInternalServerError {
+		t.Fatalf("uncoded error maps to %d", status)
+	}
+	if status := statusFor(dberror.New(dberror.Internal, "oops")); status != http.StatusInternalServerError {
+		t.Fatalf("internal error maps to %d", status)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	server := startTestServer(t)
+	// A few batches' worth
+	insertTestDocs(t, server, 50)
+
+	response, err := http.Get(docsURL(t, server, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("streamed %d as %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	if response.Header.Get("X-Gcdb-Cursor") == "" {
+		t.Fatal("no cursor header")
+	}
+	scanner := bufio.NewScanner(response.Body)
+	seen := make(map[int]bool)
+	for scanner.Scan() {
+		doc := make(map[string]interface{})
+		err = json.Unmarshal(scanner.Bytes(), &doc)
+		if err != nil {
+			t.Fatalf("%v in line %s", err, scanner.Text())
+		}
+		seen[int(doc["_id"].(float64))] = true
+	}
+	if scanner.Err() != nil {
+		t.Fatal(scanner.Err())
+	}
+	if len(seen) != 50 {
+		t.Fatalf("streamed %d documents, want 50", len(seen))
+	}
+	if cursors := openCursors(t); cursors != "No open cursors" {
+		t.Fatalf("left open: %s", cursors)
+	}
+}
+
+func TestStreamingResumesAnOpenCursor(t *testing.T) {
+	server := startTestServer(t)
+	insertTestDocs(t, server, 30)
+	session, err := api.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	run(session, "use", testDatabase(t))
+	cursorId, err := run(session, "findall", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = run(session, "getmore", string(cursorId))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := expectStatus(t, "GET", server.URL+"/docs?cursor="+string(cursorId), "", http.StatusOK)
+	if lines := strings.Count(response, "\n"); lines != 10 {
+		t.Fatalf("streamed %d documents after the first batch, want 10", lines)
+	}
+}
+
+// Hands out an error once it's been written to a few times,
+// like a connection to a client that's gone away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	if w.writes > 3 {
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestStreamingStopsWhenTheClientGoesAway(t *testing.T) {
+	server := startTestServer(t)
+	insertTestDocs(t, server, 50)
+
+	// Opened by the request itself
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	handleDocs(w, httptest.NewRequest("GET", docsURL(t, server, ""), nil))
+	if w.writes != 4 {
+		t.Fatalf("kept writing %d times after the client went away", w.writes-4)
+	}
+	if cursors := openCursors(t); cursors != "No open cursors" {
+		t.Fatalf("left open: %s", cursors)
+	}
+
+	// Opened by somebody else and resumed over HTTP
+	session, err := api.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	run(session, "use", testDatabase(t))
+	cursorId, err := run(session, "findall", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	handleDocs(w, httptest.NewRequest("GET", server.URL+"/docs?cursor="+string(cursorId), nil))
+	if cursors := openCursors(t); cursors != "No open cursors" {
+		t.Fatalf("left open: %s", cursors)
+	}
+}
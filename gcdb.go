@@ -1,56 +1,140 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
-	"github.com/edsrzf/mmap-go"
 	"github.com/gamechanger/gcdb/api"
+	"github.com/gamechanger/gcdb/config"
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/dberror"
 	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/gateway"
+	"github.com/gamechanger/gcdb/logging"
 	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/protocol"
 )
 
 const (
 	prompt = "gcdb> "
+	// How long a new connection gets to ask for the binary protocol
+	// before we decide it's a person and show them the prompt
+	negotiationTimeout = 200 * time.Millisecond
+	shuttingDown       = "The server is shutting down"
 )
 
-func initDataFiles() {
-	file, err := filesystem.EnsureCurrentDataFile()
+// Parse the flags and environment and hand the settings out to
+// the packages that use them. Returns the arguments left over.
+func configure(name string, args []string) (*config.Config, []string, error) {
+	cfg, rest, err := config.Load(name, args)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
+	level, _ := cfg.Level()
+	logging.SetLevel(level)
+	filesystem.SetDataDir(cfg.DataDir)
+	filesystem.SetDataFileSize(cfg.DataFileSize)
+	policy, _ := cfg.SyncPolicy()
+	memory.SetWALSyncPolicy(policy, time.Duration(cfg.FsyncIntervalMillis)*time.Millisecond)
+	api.SetGetMoreBatchSize(cfg.GetMoreBatchSize)
+	api.SetCursorTimeout(time.Duration(cfg.CursorTimeoutSeconds) * time.Second)
+	return cfg, rest, nil
+}
+
+// The server and every tool take this before touching anything
+// in the data directory, so only one of them uses it at a time
+func lockDataDir() error {
+	return filesystem.LockDataDir()
+}
 
-	mappedFile, err := mmap.Map(file, mmap.RDWR, 0)
+// Lock the data directory and bring it up to date if an older release
+// left it. Only for the server and the tools that write to it, the
+// rest leave the directory as they found it.
+func prepareDataDir() error {
+	err := lockDataDir()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return filesystem.MigrateLegacyLayout(constants.DefaultDatabase, constants.LegacyCollection)
+}
 
-	mdf := memory.NewMappedDataFile(&mappedFile)
-	memory.SetCurrentDataFile(mdf)
+// Fails rather than starting without a collection that's damaged,
+// gcdb verify says where
+func initDataFiles() error {
+	return database.OpenAll()
 }
 
 func main() {
-	initDataFiles()
-	memory.InitializeIndices()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+
+	cfg, _, err := configure("gcdb", os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	l, err := net.Listen("tcp", "localhost:19999")
+	err = prepareDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	memory.StartWriter()
+	err = initDataFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	watchSignals()
+	api.OnShutdown(func() {
+		requestShutdown("shutdown command")
+	})
+
+	var httpServer *http.Server
+	if cfg.HTTPListenAddr != "" {
+		httpServer = gateway.NewServer(cfg.HTTPListenAddr)
+		go func() {
+			err := httpServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+		logging.Infof("gcdb HTTP gateway listening on %s", cfg.HTTPListenAddr)
+	}
+	api.StartCursorReaper()
+	memory.StartBackgroundCompaction(constants.CompactionCheckIntervalSeconds*time.Second, constants.CompactionThreshold)
+
+	l, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
 		panic(err)
 	}
-	defer l.Close()
 
-	log.Println("gcdb listening on port 19999")
+	logging.Infof("gcdb listening on %s", cfg.ListenAddr)
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			panic(err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if isDraining() {
+					return
+				}
+				panic(err)
+			}
+			go handleRequest(conn)
 		}
-		go handleRequest(conn)
-	}
+	}()
+
+	os.Exit(shutdown(l, httpServer, <-shutdownRequests))
 }
 
 func handleRequest(conn net.Conn) {
@@ -59,31 +143,142 @@ func handleRequest(conn net.Conn) {
 			fmt.Println("Recovered in handleRequest ", r)
 		}
 	}()
+	defer conn.Close()
+	if !trackConn(conn) {
+		return
+	}
+	defer untrackConn(conn)
 
+	session, err := api.NewSession()
+	if err != nil {
+		panic(err)
+	}
+	defer session.Close()
+
+	reader := bufio.NewReader(conn)
+	binaryProtocol, err := negotiate(conn, reader)
+	if err != nil {
+		logging.Errorln("Error negotiating protocol:", err)
+		return
+	}
+	if binaryProtocol {
+		serveBinary(conn, reader, session)
+	} else {
+		servePrompt(conn, reader, session)
+	}
+}
+
+// Give the client a moment to ask for the binary protocol. If it
+// doesn't, whatever it sent stays buffered for the prompt to read.
+func negotiate(conn net.Conn, reader *bufio.Reader) (bool, error) {
+	conn.SetReadDeadline(time.Now().Add(negotiationTimeout))
+	peeked, err := reader.Peek(len(protocol.Magic) + 1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return false, nil
+		}
+		if err == io.EOF {
+			return false, err
+		}
+	}
+	if len(peeked) < len(protocol.Magic)+1 || !bytes.Equal(peeked[:len(protocol.Magic)], protocol.Magic) {
+		return false, nil
+	}
+
+	version := peeked[len(protocol.Magic)]
+	reader.Discard(len(protocol.Magic) + 1)
+	_, err = conn.Write(append(append([]byte{}, protocol.Magic...), protocol.Version))
+	if err != nil {
+		return false, err
+	}
+	if version != protocol.Version {
+		return false, errors.New(fmt.Sprintf("client wants protocol version %d, we speak %d", version, protocol.Version))
+	}
+	return true, nil
+}
+
+// One command per line, for people poking at the server by hand
+func servePrompt(conn net.Conn, reader *bufio.Reader, session *api.Session) {
 	for {
-		buf := make([]byte, 1024)
 		conn.Write([]byte(prompt))
-		_, err := conn.Read(buf)
+		line, err := reader.ReadBytes('\n')
 		if err != nil {
 			if err == io.EOF {
-				log.Println("Connection closed")
-				conn.Close()
+				logging.Debugln("Connection closed")
 				return
 			}
 			panic(err)
 		}
-		command := api.NewCommandFromInput(buf)
-		start := time.Now()
-		response, err := api.HandleCommand(command)
-		end := time.Now()
+		// Deferred so a panicking command doesn't leave shutdown waiting on it
+		ok := func() bool {
+			if !beginCommand() {
+				conn.Write([]byte(dberror.Internal.String() + ": " + shuttingDown + "\n"))
+				return false
+			}
+			defer endCommand()
+			command := api.NewCommandFromInput(line)
+			start := time.Now()
+			response, err := api.HandleCommand(session, command)
+			end := time.Now()
+			if err != nil {
+				conn.Write([]byte(dberror.CodeOf(err).String() + ": " + err.Error()))
+			} else {
+				conn.Write(response)
+			}
+			conn.Write([]byte{10})
+			conn.Write([]byte(fmt.Sprintf("Elapsed: %fms", float64(end.Sub(start))/float64(time.Millisecond))))
+			conn.Write([]byte{10, 10})
+			return true
+		}()
+		if !ok {
+			return
+		}
+	}
+}
+
+func serveBinary(conn net.Conn, reader *bufio.Reader, session *api.Session) {
+	for {
+		request, err := protocol.ReadRequest(reader)
 		if err != nil {
-			conn.Write([]byte(err.Error()))
-		} else {
-			conn.Write(response)
+			if err == io.EOF {
+				logging.Debugln("Connection closed")
+			} else {
+				logging.Errorln("Error reading request, closing connection:", err)
+			}
+			return
+		}
+
+		reply := &protocol.Reply{Id: request.Id, Status: protocol.StatusOK}
+		ok, err := func() (bool, error) {
+			if !beginCommand() {
+				reply.Status = protocol.Status(dberror.Internal)
+				reply.Body = []byte(shuttingDown)
+				protocol.WriteReply(conn, reply)
+				return false, nil
+			}
+			defer endCommand()
+			name, ok := request.Opcode.Command()
+			if !ok {
+				reply.Status = protocol.Status(dberror.BadRequest)
+				reply.Body = []byte(fmt.Sprintf("Unrecognized opcode %d", request.Opcode))
+			} else {
+				response, err := api.HandleCommand(session, api.NewCommand(name, request.Body))
+				if err != nil {
+					reply.Status = protocol.Status(dberror.CodeOf(err))
+					reply.Body = []byte(err.Error())
+				} else {
+					reply.Body = response
+				}
+			}
+			return true, protocol.WriteReply(conn, reply)
+		}()
+		if err != nil {
+			logging.Errorln("Error writing reply, closing connection:", err)
+			return
+		}
+		if !ok {
+			return
 		}
-		conn.Write([]byte{10})
-		conn.Write([]byte(fmt.Sprintf("Elapsed: %fms", float64(end.Sub(start))/float64(time.Millisecond))))
-		conn.Write([]byte{10, 10})
 	}
-	conn.Close()
 }
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gamechanger/gcdb/client"
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/protocol"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+var testAddr string
+
+// How many connections the test server has taken
+var accepted int64
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gcdb-server")
+	if err != nil {
+		panic(err)
+	}
+	filesystem.SetDataDir(dir)
+	filesystem.SetDataFileSize(1 << 16)
+	memory.SetWALSyncPolicy(wal.SyncNever, 0)
+	err = prepareDataDir()
+	if err != nil {
+		panic(err)
+	}
+	memory.StartWriter()
+	err = initDataFiles()
+	if err != nil {
+		panic(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	testAddr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			go handleRequest(conn)
+		}
+	}()
+
+	status := m.Run()
+	l.Close()
+	database.CloseAll()
+	filesystem.UnlockDataDir()
+	os.RemoveAll(dir)
+	os.Exit(status)
+}
+
+var unsafeNameChars = regexp.MustCompile("[^A-Za-z0-9_-]")
+
+// A client using a database of its own, so
+// tests don't trip over each other's collections
+func newTestClient(t *testing.T, maxConns int) *client.Client {
+	t.Helper()
+	c := client.New(client.Config{
+		Addr:     testAddr,
+		MaxConns: maxConns,
+		Database: unsafeNameChars.ReplaceAllString(t.Name(), "_"),
+	})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+type testDoc struct {
+	Id int `json:"_id"`
+	N  int `json:"n"`
+}
+
+func expectDoc(t *testing.T, c *client.Client, id, n int) {
+	t.Helper()
+	doc := testDoc{}
+	err := c.FindId(testContext(t), "test", id, &doc)
+	if err != nil {
+		t.Fatalf("finding %d: %v", id, err)
+	}
+	if doc.Id != id || doc.N != n {
+		t.Fatalf("found %+v, want n of %d", doc, n)
+	}
+}
+
+func expectNoDoc(t *testing.T, c *client.Client, id int) {
+	t.Helper()
+	err := c.FindId(testContext(t), "test", id, &testDoc{})
+	if !client.IsNotFound(err) {
+		t.Fatalf("finding %d returned %v", id, err)
+	}
+}
+
+func dialTestServer(t *testing.T) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func TestBinaryNegotiation(t *testing.T) {
+	conn := dialTestServer(t)
+	err := protocol.Negotiate(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = protocol.WriteRequest(conn, &protocol.Request{Id: 7, Opcode: protocol.OpHi})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = protocol.WriteRequest(conn, &protocol.Request{Id: 8, Opcode: protocol.Opcode(255)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := protocol.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Id != 7 || reply.Status != protocol.StatusOK {
+		t.Fatalf("hi got %+v", reply)
+	}
+	reply, err = protocol.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Id != 8 || reply.Status != protocol.Status(dberror.BadRequest) {
+		t.Fatalf("an unknown opcode got %+v", reply)
+	}
+}
+
+func TestUnknownProtocolVersion(t *testing.T) {
+	conn := dialTestServer(t)
+	_, err := conn.Write(append(append([]byte{}, protocol.Magic...), protocol.Version+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Told which version the server speaks, then hung up on
+	response := make([]byte, len(protocol.Magic)+1)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, append(append([]byte{}, protocol.Magic...), protocol.Version)) {
+		t.Fatalf("server answered %q", response)
+	}
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open: %v", err)
+	}
+}
+
+func TestPromptFallback(t *testing.T) {
+	// Someone who waits for the prompt, and someone who types straight away
+	for _, wait := range []bool{true, false} {
+		conn := dialTestServer(t)
+		reader := bufio.NewReader(conn)
+		if wait {
+			line := make([]byte, len(prompt))
+			_, err := io.ReadFull(reader, line)
+			if err != nil || string(line) != prompt {
+				t.Fatalf("read %q: %v", line, err)
+			}
+		}
+		_, err := conn.Write([]byte("findid nosuchcollection 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !wait {
+			reader.Discard(len(prompt))
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "NotFound: ") {
+			t.Fatalf("got %q", line)
+		}
+	}
+}
+
+func TestClientErrorCodes(t *testing.T) {
+	c := newTestClient(t, 1)
+	ctx := testContext(t)
+	err := c.Insert(ctx, "test", testDoc{Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Insert(ctx, "test", testDoc{Id: 1})
+	if !client.IsDuplicateKey(err) {
+		t.Fatalf("duplicate insert returned %v", err)
+	}
+	err = c.FindId(ctx, "test", 2, &testDoc{})
+	if !client.IsNotFound(err) {
+		t.Fatalf("missing document returned %v", err)
+	}
+	err = c.Insert(ctx, "test", map[string]string{"_id": "one"})
+	if !client.IsBadRequest(err) {
+		t.Fatalf("string _id returned %v", err)
+	}
+	_, err = c.GetMore(ctx, 999999, client.BatchOptions{})
+	if !client.IsCursorNotFound(err) {
+		t.Fatalf("getmore of an unknown cursor returned %v", err)
+	}
+	if e, ok := err.(*dberror.Error); !ok || e.Code != dberror.CursorNotFound || e.Message == "" {
+		t.Fatalf("server error came back as %#v", err)
+	}
+	// None of those were the connection's fault
+	expectDoc(t, c, 1, 0)
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	c := newTestClient(t, 2)
+	ctx := testContext(t)
+	before := atomic.LoadInt64(&accepted)
+	for id := 0; id < 20; id++ {
+		err := c.Insert(ctx, "test", testDoc{Id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opened := atomic.LoadInt64(&accepted) - before; opened != 1 {
+		t.Fatalf("opened %d connections one request at a time", opened)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for id := 0; id < 20; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			errs <- c.FindId(ctx, "test", id, &testDoc{})
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opened := atomic.LoadInt64(&accepted) - before; opened > 2 {
+		t.Fatalf("opened %d connections with a limit of 2", opened)
+	}
+}
+
+// Hang up every connection from the server's end
+func dropServerConns() {
+	connLock.Lock()
+	defer connLock.Unlock()
+	for conn := range openConns {
+		conn.Close()
+	}
+}
+
+func TestPoolDiscardsBrokenConnections(t *testing.T) {
+	c := newTestClient(t, 1)
+	ctx := testContext(t)
+	err := c.Insert(ctx, "test", testDoc{Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt64(&accepted)
+	dropServerConns()
+
+	err = c.FindId(ctx, "test", 1, &testDoc{})
+	if err == nil {
+		t.Fatal("request over a dropped connection succeeded")
+	}
+	if _, ok := err.(*dberror.Error); ok {
+		t.Fatalf("dropped connection came back as a server error: %v", err)
+	}
+	// The pool only holds one, so this has to be a new connection
+	expectDoc(t, c, 1, 0)
+	if opened := atomic.LoadInt64(&accepted) - before; opened != 1 {
+		t.Fatalf("opened %d connections after one broke", opened)
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	c := newTestClient(t, 1)
+	ctx := testContext(t)
+	err := c.Insert(ctx, "test", testDoc{Id: 1, N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Abort(ctx)
+	err = tx.Insert(ctx, "test", testDoc{Id: 2, N: 2})
+	if err == nil {
+		err = tx.UpdateId(ctx, "test", 1, testDoc{Id: 1, N: 10})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDoc(t, c, 1, 10)
+	expectDoc(t, c, 2, 2)
+
+	// Over once committed
+	if tx.DeleteId(ctx, "test", 1) == nil {
+		t.Fatal("wrote to a committed transaction")
+	}
+	if tx.Abort(ctx) != nil {
+		t.Fatal("abort after commit failed")
+	}
+}
+
+func TestTxAbort(t *testing.T) {
+	c := newTestClient(t, 1)
+	ctx := testContext(t)
+	err := c.Insert(ctx, "test", testDoc{Id: 1, N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.DeleteId(ctx, "test", 1)
+	if err == nil {
+		err = tx.Insert(ctx, "test", testDoc{Id: 2})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Abort(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDoc(t, c, 1, 1)
+	expectNoDoc(t, c, 2)
+}
+
+func TestTxFailedCommit(t *testing.T) {
+	c := newTestClient(t, 1)
+	ctx := testContext(t)
+	err := c.Insert(ctx, "test", testDoc{Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt64(&accepted)
+
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Insert(ctx, "test", testDoc{Id: 2})
+	if err == nil {
+		err = tx.Insert(ctx, "test", testDoc{Id: 1})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit(ctx)
+	if !client.IsDuplicateKey(err) {
+		t.Fatalf("commit returned %v", err)
+	}
+	expectNoDoc(t, c, 2)
+	// A failed commit is the server's answer, the connection's fine
+	if opened := atomic.LoadInt64(&accepted) - before; opened != 0 {
+		t.Fatalf("opened %d connections", opened)
+	}
+}
+
+func TestClientCursor(t *testing.T) {
+	c := newTestClient(t, 1)
+	ctx := testContext(t)
+	docs := make([]interface{}, 0)
+	for id := 0; id < 25; id++ {
+		docs = append(docs, testDoc{Id: id, N: id})
+	}
+	result, err := c.InsertMany(ctx, "test", docs, true)
+	if err != nil || result.Inserted != 25 {
+		t.Fatalf("inserted %+v: %v", result, err)
+	}
+
+	cursor, err := c.FindAll(ctx, "test", client.BatchOptions{BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := 0
+	for cursor.Next(ctx) {
+		doc := testDoc{}
+		err = cursor.Decode(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen++
+	}
+	if cursor.Err() != nil || seen != 25 {
+		t.Fatalf("saw %d documents: %v", seen, cursor.Err())
+	}
+	if cursor.Close(ctx) != nil {
+		t.Fatal("closing an exhausted cursor failed")
+	}
+
+	// Given up on part way through
+	cursor, err = c.FindAll(ctx, "test", client.BatchOptions{BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor.Next(ctx)
+	err = cursor.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetMore(ctx, cursor.Id, client.BatchOptions{})
+	if !client.IsCursorNotFound(err) {
+		t.Fatalf("getmore after close returned %v", err)
+	}
+}
@@ -2,10 +2,16 @@ package locks
 
 import "sync"
 
-var GlobalMetadataLock = &sync.Mutex{}
-var GlobalWriteLock = &sync.Mutex{}
+// The metadata lock guards which collections exist and the write lock
+// guards what's in them. Both are reader/writer locks: anything that
+// only reads takes RLock, so reads run alongside each other and only
+// wait for writes, which take Lock and go one at a time. When more
+// than one is needed they're taken in the order of allLocks.
+
+var GlobalMetadataLock = &sync.RWMutex{}
+var GlobalWriteLock = &sync.RWMutex{}
 var GlobalCursorLock = &sync.Mutex{}
-var allLocks = []*sync.Mutex{GlobalMetadataLock, GlobalWriteLock, GlobalCursorLock}
+var allLocks = []sync.Locker{GlobalMetadataLock, GlobalWriteLock, GlobalCursorLock}
 
 func StopTheWorld() {
 	for _, lock := range allLocks {
@@ -14,7 +20,7 @@ func StopTheWorld() {
 }
 
 func UnstopTheWorld() {
-	for _, lock := range allLocks {
-		lock.Unlock()
+	for idx := len(allLocks) - 1; idx >= 0; idx-- {
+		allLocks[idx].Unlock()
 	}
 }
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A thin layer over the standard logger that drops anything
+// below the configured level. Errors are always logged.
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+var level = LevelInfo
+
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, errors.New(fmt.Sprintf("Unknown log level %s, must be one of debug, info or error", s))
+}
+
+func SetLevel(l Level) {
+	level = l
+}
+
+func Debugf(format string, v ...interface{}) {
+	if level <= LevelDebug {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+func Debugln(v ...interface{}) {
+	if level <= LevelDebug {
+		log.Output(2, fmt.Sprintln(v...))
+	}
+}
+
+func Infof(format string, v ...interface{}) {
+	if level <= LevelInfo {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+func Infoln(v ...interface{}) {
+	if level <= LevelInfo {
+		log.Output(2, fmt.Sprintln(v...))
+	}
+}
+
+func Errorf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+}
+
+func Errorln(v ...interface{}) {
+	log.Output(2, fmt.Sprintln(v...))
+}
@@ -0,0 +1,194 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/logging"
+)
+
+// A catalog is the set of collections kept under one directory,
+// each in a subdirectory named after it. The metadata lock guards
+// which collections exist, the write lock guards what's in them.
+
+var collectionNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Every open collection, whichever catalog it belongs to,
+// so background compaction can get at all of them
+var openCollections = make(map[*Collection]bool)
+
+type Catalog struct {
+	dir         string
+	collections map[string]*Collection
+}
+
+// Open every collection found under dir
+func OpenCatalog(dir string) (*Catalog, error) {
+	err := filesystem.EnsureDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := filesystem.CollectionNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	locks.GlobalMetadataLock.Lock()
+	defer locks.GlobalMetadataLock.Unlock()
+	cat := &Catalog{dir: dir, collections: make(map[string]*Collection)}
+	for _, name := range names {
+		if !collectionNamePattern.MatchString(name) {
+			logging.Infof("Ignoring directory %s in %s, it isn't a collection", name, dir)
+			continue
+		}
+		_, err := cat.open(name)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error opening collection %s: %v", name, err))
+		}
+	}
+	return cat, nil
+}
+
+// Callers must hold the metadata lock
+func (cat *Catalog) open(name string) (*Collection, error) {
+	coll, err := openCollection(name, filesystem.CollectionDir(cat.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	cat.collections[name] = coll
+	openCollections[coll] = true
+	return coll, nil
+}
+
+func validateCollectionName(name string) error {
+	if !collectionNamePattern.MatchString(name) {
+		return dberror.New(dberror.BadRequest, fmt.Sprintf("Invalid collection name %q, use letters, digits, _ and -", name))
+	}
+	return nil
+}
+
+func (cat *Catalog) Collection(name string) (*Collection, error) {
+	locks.GlobalMetadataLock.RLock()
+	defer locks.GlobalMetadataLock.RUnlock()
+	coll, ok := cat.collections[name]
+	if !ok {
+		return nil, dberror.New(dberror.NotFound, fmt.Sprintf("No collection named %s", name))
+	}
+	return coll, nil
+}
+
+func (cat *Catalog) CreateCollection(name string) (*Collection, error) {
+	err := validateCollectionName(name)
+	if err != nil {
+		return nil, err
+	}
+	locks.GlobalMetadataLock.Lock()
+	defer locks.GlobalMetadataLock.Unlock()
+	if _, ok := cat.collections[name]; ok {
+		return nil, dberror.New(dberror.DuplicateKey, fmt.Sprintf("Collection %s already exists", name))
+	}
+	logging.Infof("Creating collection %s", name)
+	return cat.open(name)
+}
+
+// Return the named collection, creating it if it doesn't exist yet
+func (cat *Catalog) EnsureCollection(name string) (*Collection, error) {
+	err := validateCollectionName(name)
+	if err != nil {
+		return nil, err
+	}
+	// Nearly always it's there already, and looking only needs a read lock
+	if coll, err := cat.Collection(name); err == nil {
+		return coll, nil
+	}
+	locks.GlobalMetadataLock.Lock()
+	defer locks.GlobalMetadataLock.Unlock()
+	if coll, ok := cat.collections[name]; ok {
+		return coll, nil
+	}
+	logging.Infof("Creating collection %s", name)
+	return cat.open(name)
+}
+
+// Unmap the collection and delete its directory. Anyone still holding
+// the collection gets an error the next time they try to use it.
+func (cat *Catalog) DropCollection(name string) error {
+	locks.StopTheWorld()
+	defer locks.UnstopTheWorld()
+	coll, ok := cat.collections[name]
+	if !ok {
+		return dberror.New(dberror.NotFound, fmt.Sprintf("No collection named %s", name))
+	}
+	delete(cat.collections, name)
+	delete(openCollections, coll)
+	coll.dropped = true
+	err := coll.close()
+	if err != nil {
+		logging.Errorf("Error closing collection %s before dropping it: %v", name, err)
+	}
+	logging.Infof("Dropping collection %s", name)
+	return filesystem.RemoveDir(coll.dir)
+}
+
+// Checkpoint and unmap every collection for shutdown. Anyone still
+// holding one of them gets an error the next time they use it.
+func (cat *Catalog) Close() error {
+	locks.StopTheWorld()
+	defer locks.UnstopTheWorld()
+	var firstErr error
+	for name, coll := range cat.collections {
+		delete(openCollections, coll)
+		coll.closed = true
+		err := coll.close()
+		if err != nil {
+			logging.Errorf("Error closing collection %s: %v", name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	cat.collections = make(map[string]*Collection)
+	return firstErr
+}
+
+func (cat *Catalog) CollectionNames() []string {
+	locks.GlobalMetadataLock.RLock()
+	defer locks.GlobalMetadataLock.RUnlock()
+	names := make([]string, 0, len(cat.collections))
+	for name := range cat.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func registeredCollections() []*Collection {
+	locks.GlobalMetadataLock.RLock()
+	defer locks.GlobalMetadataLock.RUnlock()
+	colls := make([]*Collection, 0, len(openCollections))
+	for coll := range openCollections {
+		colls = append(colls, coll)
+	}
+	return colls
+}
+
+// Checkpoint every collection. Takes the metadata lock before the
+// write lock, same as stopping the world does.
+func (cat *Catalog) Flush() error {
+	locks.GlobalMetadataLock.RLock()
+	defer locks.GlobalMetadataLock.RUnlock()
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	for _, coll := range cat.collections {
+		err := coll.FlushCurrentFile()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
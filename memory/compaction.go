@@ -0,0 +1,269 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/google/btree"
+)
+
+// Compaction copies every live record into a fresh set of data files,
+// in the same order, and swaps them in for the old ones. Records that
+// were deleted after a pinned snapshot was taken are copied too, still
+// marked deleted, so cursors reading that snapshot don't lose them.
+// History from before the oldest pinned snapshot is gone afterwards,
+// and the version it starts from is saved as the collection's horizon.
+// Old files get unmapped at the end, so nothing else may touch the
+// data files while this happens and it runs with the world stopped.
+
+type relocation struct {
+	from Location
+	to   Location
+}
+
+type CompactionResult struct {
+	Collection     *Collection
+	BytesReclaimed uint64
+	FilesBefore    int
+	FilesAfter     int
+	relocations    []relocation // sorted by from, since we copy in order
+	end            Location
+	liveBytes      uint64
+}
+
+var compactionHooks []func(*CompactionResult)
+
+// Register a function to run after every compaction, while the
+// world is still stopped. Anything holding a Location into the
+// old data files should translate it with Relocate here.
+func OnCompaction(hook func(*CompactionResult)) {
+	compactionHooks = append(compactionHooks, hook)
+}
+
+func (l Location) Less(than Location) bool {
+	if l.File != than.File {
+		return l.File < than.File
+	}
+	return l.Offset < than.Offset
+}
+
+// Translate a location in the old data files to the location of the
+// first surviving record at or after it in the new ones
+func (cr *CompactionResult) Relocate(old Location) Location {
+	idx := sort.Search(len(cr.relocations), func(i int) bool {
+		return !cr.relocations[i].from.Less(old)
+	})
+	if idx == len(cr.relocations) {
+		return cr.end
+	}
+	return cr.relocations[idx].to
+}
+
+func (coll *Collection) usedBytes() uint64 {
+	var used uint64
+	for _, mdf := range coll.dataFiles {
+		used += uint64(mdf.offset - DataStartOffset)
+	}
+	return used
+}
+
+func (coll *Collection) ReclaimableBytes() uint64 {
+	return coll.usedBytes() - coll.liveBytes
+}
+
+func (coll *Collection) Compact() (*CompactionResult, error) {
+	locks.StopTheWorld()
+	defer locks.UnstopTheWorld()
+	err := coll.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	result, err := coll.compact()
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range compactionHooks {
+		hook(result)
+	}
+	return result, nil
+}
+
+func (coll *Collection) compact() (*CompactionResult, error) {
+	start := time.Now()
+	result := &CompactionResult{Collection: coll, FilesBefore: len(coll.dataFiles)}
+	usedBefore := coll.usedBytes()
+
+	// The log refers to locations in the old files, so empty it first
+	err := coll.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	err = filesystem.BeginCompaction(coll.dir)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := coll.copyLiveRecords(result)
+	if err != nil {
+		closeDataFiles(newFiles)
+		filesystem.AbandonCompaction(coll.dir)
+		return nil, err
+	}
+	for _, mdf := range newFiles {
+		err = mdf.Flush()
+		if err != nil {
+			closeDataFiles(newFiles)
+			filesystem.AbandonCompaction(coll.dir)
+			return nil, err
+		}
+	}
+
+	horizon := coll.oldestPinnedVersion()
+	err = coll.saveHorizon(horizon)
+	if err != nil {
+		closeDataFiles(newFiles)
+		filesystem.AbandonCompaction(coll.dir)
+		return nil, err
+	}
+
+	// The checkpointed indexes are about to point at the wrong places
+	err = coll.removeIndexCheckpoints()
+	if err != nil {
+		closeDataFiles(newFiles)
+		filesystem.AbandonCompaction(coll.dir)
+		return nil, err
+	}
+
+	err = filesystem.CommitCompaction(coll.dir, len(newFiles))
+	if err != nil {
+		closeDataFiles(newFiles)
+		filesystem.AbandonCompaction(coll.dir)
+		return nil, err
+	}
+
+	// The old files stay mapped until the compaction is committed, so
+	// a failure before here leaves the collection as it was. The
+	// mappings of the new files stay valid across the rename, so they
+	// can be used as the live data files straight away.
+	closeDataFiles(coll.dataFiles)
+	coll.dataFiles = newFiles
+	coll.currentDataFile = newFiles[len(newFiles)-1]
+	coll.horizon = horizon
+	// Upgrading old data files changes the size of every record
+	coll.liveBytes = result.liveBytes
+	newIndex := btree.New(2)
+	coll.idIndex.Ascend(func(item btree.Item) bool {
+		isd := item.(IndexSparseDocument)
+		isd.Location = result.Relocate(isd.Location)
+		newIndex.ReplaceOrInsert(isd)
+		return true
+	})
+	coll.idIndex = newIndex
+	coll.relocateSecondaryIndexes(result)
+
+	err = filesystem.FinishCompaction(coll.dir)
+	if err != nil {
+		// What we have mapped is fine, but the names on disk don't match
+		// it until RecoverCompaction finishes the swap at the next startup,
+		// and rolling over could open one of the old files
+		coll.failed = errors.New(fmt.Sprintf("compaction couldn't swap in its files: %v", err))
+		logging.Errorf("Compaction of %s: %v", coll.Name, coll.failed)
+		return nil, err
+	}
+	err = coll.saveIndexCheckpoints()
+	if err != nil {
+		logging.Errorf("Error checkpointing indexes for %s after compaction: %v", coll.Name, err)
+	}
+
+	result.FilesAfter = len(newFiles)
+	result.BytesReclaimed = usedBefore - coll.usedBytes()
+	logging.Infof("Compaction of %s reclaimed %d bytes in %v, %d data files down to %d",
+		coll.Name, result.BytesReclaimed, time.Now().Sub(start), result.FilesBefore, result.FilesAfter)
+	return result, nil
+}
+
+func (coll *Collection) copyLiveRecords(result *CompactionResult) ([]*MappedDataFile, error) {
+	newFiles := make([]*MappedDataFile, 0)
+	mdf, err := openMappedDataFileAtPath(0, filesystem.CompactionDataFilePath(coll.dir, 0))
+	if err != nil {
+		return newFiles, err
+	}
+	newFiles = append(newFiles, mdf)
+	version := coll.currentDataFile.version
+
+	resultChannel := make(chan *Document, 50)
+	stopChannel := make(chan bool, 1)
+	oldestPinned := coll.oldestPinnedVersion()
+	keep := func(doc *Document) bool {
+		return !doc.deleted || doc.deletedVersion > oldestPinned
+	}
+	go coll.scanUntil(FirstLocation(), coll.Snapshot().End, keep, resultChannel, stopChannel)
+	defer stopScan(resultChannel, stopChannel)
+	for doc := range resultChannel {
+		// Not doc.size(), the record may be coming from an older format
+		recordSize := uint64(RecordHeaderSize) + uint64(len(*doc.Document))
+		if !mdf.HasRoomFor(recordSize) {
+			mdf.version = version
+			mdf.WriteVersionHeader()
+			mdf, err = openMappedDataFileAtPath(len(newFiles), filesystem.CompactionDataFilePath(coll.dir, len(newFiles)))
+			if err != nil {
+				return newFiles, err
+			}
+			newFiles = append(newFiles, mdf)
+			if !mdf.HasRoomFor(recordSize) {
+				return newFiles, errors.New(fmt.Sprintf("Record at data.%d offset %d is too large for a data file", doc.Location.File, doc.Location.Offset))
+			}
+		}
+		to := mdf.appendRecord(*doc.Document, doc.createdVersion)
+		if doc.deleted {
+			mdf.WriteBytesAtOffset(append([]byte{1}, versionHeaderBytes(doc.deletedVersion)...), to.Offset)
+		} else {
+			result.liveBytes += recordSize
+		}
+		result.relocations = append(result.relocations, relocation{from: doc.Location, to: to})
+	}
+	mdf.version = version
+	mdf.WriteVersionHeader()
+	result.end = Location{File: mdf.number, Offset: mdf.offset}
+	return newFiles, nil
+}
+
+func closeDataFiles(mdfs []*MappedDataFile) {
+	for _, mdf := range mdfs {
+		err := mdf.Close()
+		if err != nil {
+			logging.Errorf("Error closing data file data.%d: %v", mdf.number, err)
+		}
+	}
+}
+
+// Periodically compact any open collection once at least the given
+// fraction of the used space in its data files is reclaimable
+func StartBackgroundCompaction(interval time.Duration, threshold float64) {
+	go func() {
+		for range time.Tick(interval) {
+			for _, coll := range registeredCollections() {
+				locks.GlobalWriteLock.RLock()
+				if coll.checkOpen() != nil {
+					locks.GlobalWriteLock.RUnlock()
+					continue
+				}
+				used := coll.usedBytes()
+				reclaimable := used - coll.liveBytes
+				locks.GlobalWriteLock.RUnlock()
+				if used == 0 || float64(reclaimable)/float64(used) < threshold {
+					continue
+				}
+				logging.Infof("%d of %d used bytes in %s are reclaimable, starting background compaction", reclaimable, used, coll.Name)
+				_, err := coll.Compact()
+				if err != nil {
+					logging.Errorf("Background compaction of %s failed: %v", coll.Name, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,190 @@
+package memory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gamechanger/gcdb/filesystem"
+)
+
+func evens(ids []int) []int {
+	kept := make([]int, 0, len(ids)/2)
+	for _, id := range ids {
+		if id%2 == 0 {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+func odds(ids []int) []int {
+	kept := make([]int, 0, len(ids)/2)
+	for _, id := range ids {
+		if id%2 == 1 {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+func TestCompactReclaimsDeletedRecords(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	ids := idRange(0, 200)
+	insertTestDocs(t, coll, ids...)
+	deleteTestDocs(t, coll, odds(ids)...)
+
+	result, err := coll.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BytesReclaimed == 0 || result.FilesAfter >= result.FilesBefore {
+		t.Fatalf("reclaimed %d bytes going from %d files to %d", result.BytesReclaimed, result.FilesBefore, result.FilesAfter)
+	}
+	if coll.ReclaimableBytes() != 0 {
+		t.Fatalf("%d bytes still reclaimable", coll.ReclaimableBytes())
+	}
+	expectIds(t, scanTestIds(t, coll), evens(ids))
+	for _, id := range []int{0, 1, 100, 199} {
+		if doc := findTestDoc(t, coll, id); (doc != nil) != (id%2 == 0) {
+			t.Fatalf("after compaction found %d: %v", id, doc)
+		}
+	}
+
+	// Writes go on in the new files and everything survives a restart
+	insertTestDocs(t, coll, 1000)
+	closeTestCollection(t, coll)
+	coll = openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	expectIds(t, scanTestIds(t, coll), append(evens(ids), 1000))
+	if _, err := os.Stat(filepath.Join(dir, "compacting")); !os.IsNotExist(err) {
+		t.Fatalf("compaction directory left behind: %v", err)
+	}
+}
+
+func copyDir(t *testing.T, from, to string) {
+	t.Helper()
+	err := os.MkdirAll(to, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(from, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(to, file.Name()), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Leave crashed with the compacted files of a collection with ids
+// in dir/compacting, committed or not, and the originals in place
+func crashedCompaction(t *testing.T, ids []int, committed bool) string {
+	t.Helper()
+	original := t.TempDir()
+	coll := openTestCollection(t, original)
+	insertTestDocs(t, coll, ids...)
+	deleteTestDocs(t, coll, odds(ids)...)
+	closeTestCollection(t, coll)
+
+	// Compact a copy to get the files the crashed compaction had written
+	compacted := t.TempDir()
+	copyDir(t, original, compacted)
+	coll = openTestCollection(t, compacted)
+	_, err := coll.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeTestCollection(t, coll)
+
+	err = filesystem.BeginCompaction(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nums, err := filesystem.DataFileNumbers(compacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, num := range nums {
+		data, err := ioutil.ReadFile(filesystem.DataFilePath(compacted, num))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filesystem.CompactionDataFilePath(original, num), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compaction drops the checkpoint before it commits
+	os.Remove(filesystem.IdIndexCheckpointPath(original))
+	if committed {
+		err = filesystem.CommitCompaction(original, len(nums))
+	} else {
+		err = ioutil.WriteFile(filepath.Join(original, "compacting", "COMPLETE"), nil, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return original
+}
+
+func TestCommittedCompactionIsFinishedAtStartup(t *testing.T) {
+	ids := idRange(0, 200)
+	dir := crashedCompaction(t, ids, true)
+	before, err := filesystem.DataFileNumbers(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	expectIds(t, scanTestIds(t, coll), evens(ids))
+	if len(coll.dataFiles) >= len(before) {
+		t.Fatalf("still %d data files, had %d before compacting", len(coll.dataFiles), len(before))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "compacting")); !os.IsNotExist(err) {
+		t.Fatalf("compaction directory left behind: %v", err)
+	}
+}
+
+func TestCompactionCrashedMidSwapIsFinishedAtStartup(t *testing.T) {
+	ids := idRange(0, 200)
+	dir := crashedCompaction(t, ids, true)
+	// Go down after the first file was moved into place
+	err := os.Rename(filesystem.CompactionDataFilePath(dir, 0), filesystem.DataFilePath(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	expectIds(t, scanTestIds(t, coll), evens(ids))
+}
+
+func TestCompactionWithTornMarkerIsAbandoned(t *testing.T) {
+	ids := idRange(0, 200)
+	dir := crashedCompaction(t, ids, false)
+
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	// Nothing was compacted, so the deletes are still taking up room
+	expectIds(t, scanTestIds(t, coll), evens(ids))
+	if coll.ReclaimableBytes() == 0 {
+		t.Fatal("the compacted files were used")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "compacting")); !os.IsNotExist(err) {
+		t.Fatalf("compaction directory left behind: %v", err)
+	}
+}
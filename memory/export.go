@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gamechanger/gcdb/filesystem"
+)
+
+// Reading documents straight out of a collection's data files without
+// a server, for the export and dump tools. The files are mapped read
+// only and nothing gets replayed or recovered, so the collection has
+// to have been shut down cleanly.
+
+// Call fn with every live document in the collection stored in dir,
+// in the order they're stored, and return how many there were
+func ExportOffline(dir string, fn func(data []byte) error) (int, error) {
+	err := checkShutDownCleanly(dir)
+	if err != nil {
+		return 0, err
+	}
+	nums, err := filesystem.DataFileNumbers(dir)
+	if err != nil {
+		return 0, err
+	}
+	coll := &Collection{Name: dir, dir: dir}
+	defer func() {
+		closeDataFiles(coll.dataFiles)
+	}()
+	for _, num := range nums {
+		mdf, err := openMappedDataFileReadOnly(dir, num)
+		if err != nil {
+			return 0, err
+		}
+		coll.dataFiles = append(coll.dataFiles, mdf)
+		err = mdf.readHeader()
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("%s: %v", dir, err))
+		}
+		if mdf.offset < DataStartOffset || uint64(mdf.offset) > uint64(len(*mdf.mappedFile)) {
+			return 0, errors.New(fmt.Sprintf("Header of %s/data.%d claims the data ends at offset %d", dir, num, mdf.offset))
+		}
+	}
+	coll.currentDataFile = coll.dataFiles[len(coll.dataFiles)-1]
+
+	// Scanning as of the last file's version rather than each file's own,
+	// since records in older files get deleted at versions later than theirs
+	resultChannel := make(chan *Document, 50)
+	stopChannel := make(chan bool, 1)
+	go coll.CollectionScan(FirstLocation(), resultChannel, stopChannel)
+	defer stopScan(resultChannel, stopChannel)
+	numDocs := 0
+	for doc := range resultChannel {
+		err = fn(*doc.Document)
+		if err != nil {
+			return numDocs, err
+		}
+		numDocs++
+	}
+	return numDocs, nil
+}
+
+// Anything left in the log or an unfinished compaction means
+// the data files alone don't say what's in the collection
+func checkShutDownCleanly(dir string) error {
+	info, err := os.Stat(filesystem.WALPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && info.Size() > 0 {
+		return errors.New(fmt.Sprintf("The write-ahead log in %s isn't empty, start and stop the server once to replay it first", dir))
+	}
+	interrupted, err := filesystem.CompactionInterrupted(dir)
+	if err != nil {
+		return err
+	}
+	if interrupted {
+		return errors.New(fmt.Sprintf("A compaction of %s was interrupted, start and stop the server once to finish it first", dir))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package memory
+
+import (
+	"fmt"
+
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/logging"
+)
+
+// Writes from every connection are applied by a single writer
+// goroutine. Each pass it takes everything that has queued up since
+// the last one, plans each collection's share as one batch and logs
+// and applies it with a single append to the write-ahead log. Only
+// then does it tell each caller how their writes went, so with the
+// log fsynced on every write one fsync covers the whole batch.
+
+type writeRequest struct {
+	coll   *Collection
+	groups [][]Write
+	// Stop at the first group that fails instead of trying every one
+	ordered bool
+	done    chan []error
+	// Set instead of any results if the request couldn't be tried at all
+	err error
+}
+
+var writeQueue = make(chan *writeRequest, constants.WriteQueueLength)
+
+// Must be called before anything calls ApplyWrites
+func StartWriter() {
+	go func() {
+		for request := range writeQueue {
+			requests := []*writeRequest{request}
+		more:
+			for len(requests) < constants.MaxWriteBatch {
+				select {
+				case request := <-writeQueue:
+					requests = append(requests, request)
+				default:
+					break more
+				}
+			}
+			results := applyRequests(requests)
+			for idx, request := range requests {
+				request.done <- results[idx]
+			}
+		}
+	}()
+}
+
+// Apply every write in order, or none of them if any would fail.
+// Returns once they're as durable as the fsync policy promises.
+func (coll *Collection) ApplyWrites(writes []Write) error {
+	results, err := coll.ApplyWriteGroups([][]Write{writes}, true)
+	if err != nil {
+		return err
+	}
+	return results[0]
+}
+
+// Apply each group as if it had come in on its own, returning how each
+// one went. If ordered it stops at the first group that fails, and
+// there are only results for the groups up to and including that one.
+// If none of them could be tried, say because the collection has been
+// dropped, there are no results, only the error.
+func (coll *Collection) ApplyWriteGroups(groups [][]Write, ordered bool) ([]error, error) {
+	request := &writeRequest{coll: coll, groups: groups, ordered: ordered, done: make(chan []error, 1)}
+	writeQueue <- request
+	results := <-request.done
+	return results, request.err
+}
+
+// Returns how each request went, in the order they came
+func applyRequests(requests []*writeRequest) (results [][]error) {
+	results = make([][]error, len(requests))
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	// Nobody else is there to recover this goroutine
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Errorf("Recovered in the writer: %v", r)
+			err := dberror.New(dberror.Internal, fmt.Sprintf("Error applying writes: %v", r))
+			for idx, request := range requests {
+				results[idx] = nil
+				request.err = err
+			}
+		}
+	}()
+
+	batches := make(map[*Collection]*writeBatch)
+	order := make([]*writeBatch, 0, 1)
+	batchOf := make([]*writeBatch, len(requests))
+	for idx, request := range requests {
+		err := request.coll.checkOpen()
+		if err != nil {
+			request.err = err
+			continue
+		}
+		b, ok := batches[request.coll]
+		if !ok {
+			b = request.coll.newWriteBatch()
+			batches[request.coll] = b
+			order = append(order, b)
+		}
+		batchOf[idx] = b
+		results[idx] = make([]error, 0, len(request.groups))
+		for _, group := range request.groups {
+			err := b.add(group)
+			results[idx] = append(results[idx], err)
+			if err != nil && request.ordered {
+				break
+			}
+		}
+	}
+
+	for _, b := range order {
+		err := b.commit()
+		if err != nil {
+			for idx := range requests {
+				if batchOf[idx] != b {
+					continue
+				}
+				for group := range results[idx] {
+					if results[idx][group] == nil {
+						results[idx][group] = err
+					}
+				}
+			}
+		}
+	}
+	logging.Debugf("Applied %d write requests to %d collections in one pass", len(requests), len(order))
+	return results
+}
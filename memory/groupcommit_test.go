@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/gamechanger/gcdb/dberror"
+)
+
+func insertGroups(ids ...int) [][]Write {
+	groups := make([][]Write, 0, len(ids))
+	for _, id := range ids {
+		groups = append(groups, []Write{{Kind: InsertWrite, Id: id, Data: testDoc(id)}})
+	}
+	return groups
+}
+
+func TestOrderedGroupsStopAtFirstFailure(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	insertTestDocs(t, coll, 2)
+
+	results, err := coll.ApplyWriteGroups(insertGroups(1, 2, 3), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0] != nil || !dberror.Is(results[1], dberror.DuplicateKey) {
+		t.Fatalf("got results %v", results)
+	}
+	expectIds(t, scanTestIds(t, coll), []int{2, 1})
+}
+
+func TestUnorderedGroupsAreEachTried(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	insertTestDocs(t, coll, 2)
+
+	// A group fails as a whole, so 5 goes in with 4 and not with 3
+	groups := insertGroups(1, 2, 3)
+	groups[2] = append(groups[2], Write{Kind: InsertWrite, Id: 1, Data: testDoc(1)})
+	groups = append(groups, append(insertGroups(4)[0], insertGroups(5)[0]...))
+	results, err := coll.ApplyWriteGroups(groups, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[0] != nil || results[1] == nil || results[2] == nil || results[3] != nil {
+		t.Fatalf("got results %v", results)
+	}
+	expectIds(t, scanTestIds(t, coll), []int{2, 1, 4, 5})
+}
+
+// Requests from many callers get batched together by the writer,
+// and each caller still has to hear how its own writes went
+func TestEveryCallerGetsItsOwnResult(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	other := openTestCollection(t, t.TempDir())
+	defer closeTestCollection(t, other)
+
+	const callers = 50
+	results := make([]error, callers)
+	var wg sync.WaitGroup
+	for caller := 0; caller < callers; caller++ {
+		wg.Add(1)
+		go func(caller int) {
+			defer wg.Done()
+			target := coll
+			if caller%5 == 0 {
+				target = other
+			}
+			// Odd callers all fight over the same _id
+			id := caller
+			if caller%2 == 1 {
+				id = 1000
+			}
+			results[caller] = target.ApplyWrites([]Write{{Kind: InsertWrite, Id: id, Data: testDoc(id)}})
+		}(caller)
+	}
+	wg.Wait()
+
+	winners := make(map[*Collection]int)
+	for caller, err := range results {
+		target := coll
+		if caller%5 == 0 {
+			target = other
+		}
+		switch {
+		case caller%2 == 0 && err != nil:
+			t.Fatalf("caller %d failed: %v", caller, err)
+		case caller%2 == 1 && err == nil:
+			winners[target]++
+		case caller%2 == 1 && !dberror.Is(err, dberror.DuplicateKey):
+			t.Fatalf("caller %d got %v", caller, err)
+		}
+	}
+	if winners[coll] != 1 || winners[other] != 1 {
+		t.Fatalf("%d and %d inserts of the same _id went in", winners[coll], winners[other])
+	}
+	if coll.Len() != 21 || other.Len() != 6 {
+		t.Fatalf("%d and %d documents", coll.Len(), other.Len())
+	}
+}
+
+func TestDroppedCollectionFailsWholeRequest(t *testing.T) {
+	cat, err := OpenCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cat.Close()
+	coll, err := cat.CreateCollection("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cat.DropCollection("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ordered := range []bool{true, false} {
+		for _, groups := range [][][]Write{insertGroups(1, 2, 3), nil} {
+			results, err := coll.ApplyWriteGroups(groups, ordered)
+			if results != nil || !dberror.Is(err, dberror.NotFound) {
+				t.Fatalf("ordered %v with %d groups: got results %v and %v", ordered, len(groups), results, err)
+			}
+		}
+	}
+	if err := coll.ApplyWrites(insertGroups(1)[0]); !dberror.Is(err, dberror.NotFound) {
+		t.Fatalf("got %v", err)
+	}
+}
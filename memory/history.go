@@ -0,0 +1,86 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/logging"
+)
+
+// Deleted records stay in the data files until compaction, so any
+// version back to the collection's horizon can still be read.
+
+// The document with the given _id as it stood at version, or nil if
+// it didn't exist then. Has to read every data file to find it.
+func (coll *Collection) FindIdAsOf(id int, version uint64) (*Document, error) {
+	err := coll.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := coll.Snapshot()
+	if version > snapshot.Version {
+		return nil, dberror.New(dberror.BadRequest, fmt.Sprintf("Version %d is in the future, %s is at version %d", version, coll.Name, snapshot.Version))
+	}
+	if version < coll.horizon {
+		return nil, dberror.New(dberror.BadRequest, fmt.Sprintf("History of %s before version %d has been compacted away", coll.Name, coll.horizon))
+	}
+	snapshot.Version = version
+	return coll.collectionScanForIdIn(id, snapshot)
+}
+
+func (coll *Collection) loadHorizon() error {
+	data, err := ioutil.ReadFile(filesystem.HorizonPath(coll.dir))
+	if os.IsNotExist(err) {
+		coll.horizon = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	coll.horizon, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return err
+}
+
+func (coll *Collection) saveHorizon(horizon uint64) error {
+	return filesystem.WriteFileAtomically(filesystem.HorizonPath(coll.dir), []byte(strconv.FormatUint(horizon, 10)))
+}
+
+func (coll *Collection) hasUnversionedDataFiles() bool {
+	for _, mdf := range coll.dataFiles {
+		if mdf.format != formatVersioned {
+			return true
+		}
+	}
+	return false
+}
+
+// Compaction would quietly leave corrupt records behind when it
+// upgrades old data files, and building the indexes can't cope with
+// them either, so check the files over before anything reads them
+func (coll *Collection) checkUpgradable() error {
+	report, err := coll.Verify()
+	if err != nil {
+		return err
+	}
+	if len(report.Corrupt) > 0 {
+		return errors.New(fmt.Sprintf("Refusing to upgrade the data files of %s, %d corrupt records turned up. "+
+			"Run gcdb verify for the details. First was: %v", coll.Name, len(report.Corrupt), report.Corrupt[0]))
+	}
+	return nil
+}
+
+// Data files from before records carried the version that created them
+// get rewritten by a compaction. We can't know when their records were
+// created, so they're treated as always having been there and history
+// starts from now.
+func (coll *Collection) upgradeDataFiles() error {
+	logging.Infof("Upgrading the data files of %s to versioned records", coll.Name)
+	_, err := coll.compact()
+	return err
+}
@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/locks"
+)
+
+func findTestDocAsOf(t *testing.T, coll *Collection, id int, version uint64) map[string]interface{} {
+	t.Helper()
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	doc, err := coll.FindIdAsOf(id, version)
+	if err != nil {
+		t.Fatalf("finding %d as of %d: %v", id, version, err)
+	}
+	if doc == nil {
+		return nil
+	}
+	return decodeTestDoc(t, *doc.Document)
+}
+
+func scanTestSnapshot(t *testing.T, coll *Collection, snapshot Snapshot) []int {
+	t.Helper()
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	return scanIdsIn(t, coll, snapshot)
+}
+
+func TestSnapshotSeesOldVersions(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	insertTestDocs(t, coll, idRange(0, 10)...)
+	snapshot := coll.Snapshot()
+
+	applyTestWrite(t, coll, UpdateWrite, 3, `{"_id":3,"n":300}`)
+	deleteTestDocs(t, coll, 4)
+	insertTestDocs(t, coll, 20)
+
+	expectIds(t, scanTestSnapshot(t, coll, snapshot), idRange(0, 10))
+	expectIds(t, scanTestIds(t, coll), []int{0, 1, 2, 5, 6, 7, 8, 9, 3, 20})
+
+	if doc := findTestDocAsOf(t, coll, 3, snapshot.Version); doc["n"] != float64(3) {
+		t.Fatalf("3 as of the snapshot is %v", doc)
+	}
+	if doc := findTestDocAsOf(t, coll, 3, coll.Snapshot().Version); doc["n"] != float64(300) {
+		t.Fatalf("3 as of now is %v", doc)
+	}
+	if findTestDocAsOf(t, coll, 4, snapshot.Version) == nil || findTestDocAsOf(t, coll, 4, coll.Snapshot().Version) != nil {
+		t.Fatal("4 should only be there as of the snapshot")
+	}
+	if findTestDocAsOf(t, coll, 20, snapshot.Version) != nil {
+		t.Fatal("20 turned up before it was inserted")
+	}
+	if _, err := coll.FindIdAsOf(3, coll.Snapshot().Version+1); err == nil {
+		t.Fatal("found a document as of a version in the future")
+	}
+}
+
+func TestPinnedSnapshotSurvivesCompaction(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	ids := idRange(0, 100)
+	insertTestDocs(t, coll, ids...)
+	locks.GlobalWriteLock.RLock()
+	pinned := coll.PinSnapshot()
+	locks.GlobalWriteLock.RUnlock()
+	deleteTestDocs(t, coll, odds(ids)...)
+
+	result, err := coll.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned = pinned.Relocate(result)
+	expectIds(t, scanTestSnapshot(t, coll, pinned), ids)
+	expectIds(t, scanTestIds(t, coll), evens(ids))
+	if findTestDocAsOf(t, coll, 1, pinned.Version) == nil {
+		t.Fatal("compaction dropped a record the pinned snapshot needs")
+	}
+
+	// Once nobody needs them the deleted records can go
+	coll.UnpinSnapshot(pinned)
+	_, err = coll.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coll.ReclaimableBytes() != 0 {
+		t.Fatalf("%d bytes left to reclaim", coll.ReclaimableBytes())
+	}
+	if _, err := coll.FindIdAsOf(1, pinned.Version); err == nil {
+		t.Fatal("found a document as of a version compacted away")
+	}
+}
+
+func TestLegacyDataFilesAreUpgraded(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacyDataFile(t, dir, 0, formatOriginal, 50, legacyRecords(idRange(0, 20), 40, 41))
+	writeLegacyDataFile(t, dir, 1, formatChecksummed, 100, legacyRecords(idRange(20, 40), 42))
+
+	coll := openTestCollection(t, dir)
+	for _, mdf := range coll.dataFiles {
+		if mdf.format != formatVersioned {
+			t.Fatalf("data.%d still has format %d", mdf.number, mdf.format)
+		}
+	}
+	expectIds(t, scanTestIds(t, coll), idRange(0, 40))
+	if coll.ReclaimableBytes() != 0 || findTestDoc(t, coll, 40) != nil {
+		t.Fatal("deleted records survived the upgrade")
+	}
+	insertTestDocs(t, coll, 100)
+	closeTestCollection(t, coll)
+
+	coll = openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	expectIds(t, scanTestIds(t, coll), append(idRange(0, 40), 100))
+}
+
+func TestCorruptLegacyDataFilesAreNotUpgraded(t *testing.T) {
+	dir := t.TempDir()
+	records := legacyRecords(idRange(0, 10))
+	// Without checksums the old format can only be caught out by
+	// a record that isn't a document
+	records[5].data = []byte(`{"_id":5,"n":`)
+	writeLegacyDataFile(t, dir, 0, formatOriginal, 50, records)
+	before, err := ioutil.ReadFile(filesystem.DataFilePath(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coll, err := openCollection("test", dir)
+	if err == nil {
+		closeTestCollection(t, coll)
+		t.Fatal("upgraded data files with a corrupt record")
+	}
+	if !strings.Contains(err.Error(), "Refusing to upgrade") {
+		t.Fatalf("wrong error: %v", err)
+	}
+	after, err := ioutil.ReadFile(filesystem.DataFilePath(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("data file changed by a refused upgrade")
+	}
+}
@@ -0,0 +1,335 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/google/btree"
+)
+
+// The indexes get checkpointed to disk every time the data files
+// are flushed, so startup only has to look at what changed since.
+// Here's the format for the _id index's checkpoint file:
+// First eight bytes: uint64 op version of the data files it reflects
+// Next four bytes: uint32 number of the last data file
+// Next four bytes: uint32 write offset in that file
+// Next eight bytes: uint64 number of entries
+// Then for each entry, in _id order:
+// Eight bytes: int64 _id
+// Four bytes: uint32 data file number
+// Four bytes: uint32 offset within that file
+// Last four bytes: uint32 CRC-32 (IEEE) of everything before it
+
+// The secondary indexes go in a file of their own, which starts with
+// the same first sixteen bytes and is only any use if they match:
+// Next four bytes: uint32 number of indexes
+// Then for each index, in path order:
+// Four bytes: uint32 length of the path, then the path
+// Eight bytes: uint64 number of entries
+// Then for each entry, in index order:
+// Four bytes: uint32 length of the value, then the value as JSON
+// Eight bytes: int64 _id
+// Four bytes: uint32 data file number
+// Four bytes: uint32 offset within that file
+// Last four bytes: uint32 CRC-32 (IEEE) of everything before it
+
+const (
+	checkpointPositionSize = 8 + 4 + 4
+	idCheckpointHeaderSize = checkpointPositionSize + 8
+	idCheckpointEntrySize  = 8 + 4 + 4
+)
+
+// Callers must hold the write lock and have flushed the data files
+func (coll *Collection) saveIndexCheckpoints() error {
+	err := coll.saveIdIndexCheckpoint()
+	if err != nil {
+		return err
+	}
+	return coll.saveSecondaryIndexCheckpoint()
+}
+
+func (coll *Collection) removeIndexCheckpoints() error {
+	err := removeIfExists(filesystem.IdIndexCheckpointPath(coll.dir))
+	if err != nil {
+		return err
+	}
+	return removeIfExists(filesystem.SecondaryIndexCheckpointPath(coll.dir))
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Where the data files are up to, which a checkpoint has to match
+func (coll *Collection) checkpointPosition() []byte {
+	position := make([]byte, checkpointPositionSize)
+	binary.BigEndian.PutUint64(position, coll.currentDataFile.version)
+	binary.BigEndian.PutUint32(position[8:], coll.currentDataFile.number)
+	binary.BigEndian.PutUint32(position[12:], coll.currentDataFile.offset)
+	return position
+}
+
+func (coll *Collection) saveIdIndexCheckpoint() error {
+	idIndex := coll.idIndex
+	var buf bytes.Buffer
+	buf.Grow(idCheckpointHeaderSize + idIndex.Len()*idCheckpointEntrySize + 4)
+	buf.Write(coll.checkpointPosition())
+	numEntries := make([]byte, 8)
+	binary.BigEndian.PutUint64(numEntries, uint64(idIndex.Len()))
+	buf.Write(numEntries)
+
+	entry := make([]byte, idCheckpointEntrySize)
+	idIndex.Ascend(func(item btree.Item) bool {
+		isd := item.(IndexSparseDocument)
+		binary.BigEndian.PutUint64(entry, uint64(int64(isd.Id)))
+		binary.BigEndian.PutUint32(entry[8:], isd.Location.File)
+		binary.BigEndian.PutUint32(entry[12:], isd.Location.Offset)
+		buf.Write(entry)
+		return true
+	})
+
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(checksum)
+	return filesystem.WriteFileAtomically(filesystem.IdIndexCheckpointPath(coll.dir), buf.Bytes())
+}
+
+func (coll *Collection) saveSecondaryIndexCheckpoint() error {
+	if len(coll.secondaryIndexes) == 0 {
+		return removeIfExists(filesystem.SecondaryIndexCheckpointPath(coll.dir))
+	}
+	var buf bytes.Buffer
+	buf.Write(coll.checkpointPosition())
+	buf.Write(uint32Bytes(uint32(len(coll.secondaryIndexes))))
+	entry := make([]byte, idCheckpointEntrySize)
+	var err error
+	for _, path := range coll.IndexedPaths() {
+		si := coll.secondaryIndexes[path]
+		buf.Write(uint32Bytes(uint32(len(path))))
+		buf.WriteString(path)
+		numEntries := make([]byte, 8)
+		binary.BigEndian.PutUint64(numEntries, uint64(si.Len()))
+		buf.Write(numEntries)
+		si.tree.Ascend(func(item btree.Item) bool {
+			indexEntry := item.(SecondaryIndexEntry)
+			var value []byte
+			value, err = json.Marshal(indexEntry.Value)
+			if err != nil {
+				return false
+			}
+			buf.Write(uint32Bytes(uint32(len(value))))
+			buf.Write(value)
+			binary.BigEndian.PutUint64(entry, uint64(int64(indexEntry.Id)))
+			binary.BigEndian.PutUint32(entry[8:], indexEntry.Location.File)
+			binary.BigEndian.PutUint32(entry[12:], indexEntry.Location.Offset)
+			buf.Write(entry)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	buf.Write(uint32Bytes(crc32.ChecksumIEEE(buf.Bytes())))
+	return filesystem.WriteFileAtomically(filesystem.SecondaryIndexCheckpointPath(coll.dir), buf.Bytes())
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+// Load the checkpoint, drop anything deleted since it was taken and
+// index everything written after it. Returns false if there was no
+// usable checkpoint, in which case the caller should do a full scan.
+func (coll *Collection) loadIdIndexCheckpoint() (bool, error) {
+	data, err := ioutil.ReadFile(filesystem.IdIndexCheckpointPath(coll.dir))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+
+	if len(data) < idCheckpointHeaderSize+4 {
+		return false, errors.New("checkpoint file is truncated")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return false, errors.New("checkpoint file failed its checksum")
+	}
+	version := binary.BigEndian.Uint64(body)
+	end := Location{File: binary.BigEndian.Uint32(body[8:]), Offset: binary.BigEndian.Uint32(body[12:])}
+	numEntries := binary.BigEndian.Uint64(body[16:])
+	if uint64(len(body)) != idCheckpointHeaderSize+numEntries*idCheckpointEntrySize {
+		return false, errors.New("checkpoint file has the wrong number of entries")
+	}
+	currentDataFile := coll.currentDataFile
+	current := Location{File: currentDataFile.number, Offset: currentDataFile.offset}
+	if version > currentDataFile.version || current.Less(end) {
+		return false, errors.New(fmt.Sprintf("checkpoint at version %d is ahead of the data files at version %d", version, currentDataFile.version))
+	}
+
+	// Everything in the checkpoint has to be there before we catch up
+	// on what came after, since catching up adds to every index
+	if len(coll.secondaryIndexes) > 0 {
+		err = coll.loadSecondaryIndexCheckpoint(body[:checkpointPositionSize])
+		if err != nil {
+			return false, err
+		}
+	}
+
+	numDeleted := 0
+	for pos := uint64(idCheckpointHeaderSize); pos < uint64(len(body)); pos += idCheckpointEntrySize {
+		isd := IndexSparseDocument{
+			Id: int(int64(binary.BigEndian.Uint64(body[pos:]))),
+			Location: Location{
+				File:   binary.BigEndian.Uint32(body[pos+8:]),
+				Offset: binary.BigEndian.Uint32(body[pos+12:])},
+		}
+		mdf, err := coll.dataFileForLocation(isd.Location)
+		if err != nil {
+			return false, err
+		}
+		deleted, length, err := mdf.readRecordHeader(isd.Location.Offset)
+		if err != nil {
+			return false, err
+		}
+		if deleted {
+			numDeleted++
+			continue
+		}
+		coll.liveBytes += uint64(mdf.recordHeaderSize()) + uint64(length)
+		coll.idIndex.ReplaceOrInsert(isd)
+	}
+
+	numNew, err := coll.catchUpIdIndex(end)
+	if err != nil {
+		return false, err
+	}
+	logging.Infof("Loaded _id index checkpoint for %s from version %d in %v: %d entries, %d since deleted, %d written since",
+		coll.Name, version, time.Now().Sub(start), numEntries, numDeleted, numNew)
+	return true, nil
+}
+
+// Fill in the secondary indexes from their checkpoint, which has to be
+// of the same point in the data files as the _id index's given in
+// position, dropping anything deleted since
+func (coll *Collection) loadSecondaryIndexCheckpoint(position []byte) error {
+	data, err := ioutil.ReadFile(filesystem.SecondaryIndexCheckpointPath(coll.dir))
+	if err != nil {
+		return err
+	}
+	if len(data) < checkpointPositionSize+4+4 {
+		return errors.New("secondary index checkpoint file is truncated")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return errors.New("secondary index checkpoint file failed its checksum")
+	}
+	if !bytes.Equal(body[:checkpointPositionSize], position) {
+		return errors.New("secondary index checkpoint was taken at a different point than the _id index's")
+	}
+
+	r := &checkpointReader{data: body, pos: checkpointPositionSize}
+	numIndexes := r.uint32()
+	if int(numIndexes) != len(coll.secondaryIndexes) {
+		return errors.New(fmt.Sprintf("secondary index checkpoint has %d indexes, the collection has %d", numIndexes, len(coll.secondaryIndexes)))
+	}
+	for idx := uint32(0); idx < numIndexes && r.err == nil; idx++ {
+		path := string(r.next(uint64(r.uint32())))
+		si, ok := coll.secondaryIndexes[path]
+		if !ok {
+			return errors.New(fmt.Sprintf("secondary index checkpoint has an index on %s, the collection doesn't", path))
+		}
+		numEntries := r.uint64()
+		for entryNum := uint64(0); entryNum < numEntries && r.err == nil; entryNum++ {
+			var value interface{}
+			err = json.Unmarshal(r.next(uint64(r.uint32())), &value)
+			if r.err == nil && err != nil {
+				return err
+			}
+			entry := SecondaryIndexEntry{
+				Value:    value,
+				Id:       int(int64(r.uint64())),
+				Location: Location{File: r.uint32(), Offset: r.uint32()},
+			}
+			if r.err != nil {
+				break
+			}
+			mdf, err := coll.dataFileForLocation(entry.Location)
+			if err != nil {
+				return err
+			}
+			deleted, _, err := mdf.readRecordHeader(entry.Location.Offset)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				si.tree.ReplaceOrInsert(entry)
+			}
+		}
+	}
+	if r.err == nil && r.pos != uint64(len(body)) {
+		return errors.New("secondary index checkpoint file has trailing bytes")
+	}
+	return r.err
+}
+
+// Reads through a checkpoint file, remembering if it runs off the end
+type checkpointReader struct {
+	data []byte
+	pos  uint64
+	err  error
+}
+
+func (r *checkpointReader) next(n uint64) []byte {
+	if r.err != nil || r.pos+n > uint64(len(r.data)) {
+		r.err = errors.New("checkpoint file is truncated")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *checkpointReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *checkpointReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// Just enough of a record to tell whether it's still live
+func (mdf *MappedDataFile) readRecordHeader(offset uint32) (deleted bool, length uint32, err error) {
+	layout := mdf.recordLayout()
+	if uint64(offset)+uint64(layout.headerSize) > uint64(mdf.offset) {
+		return false, 0, &CorruptRecordError{Location: Location{File: mdf.number, Offset: offset}, Reason: "header runs past the end of the data"}
+	}
+	headerBytes := mdf.ReadBytesAtOffset(layout.headerSize, offset)
+	return (*headerBytes)[0] == 1, binary.BigEndian.Uint32((*headerBytes)[layout.lengthAt:]), nil
+}
@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/google/btree"
+)
+
+// Open the collection in dir as openCollection would, but fail
+// the test if the indexes didn't come from their checkpoints
+func openFromCheckpoint(t *testing.T, dir string) *Collection {
+	t.Helper()
+	coll := &Collection{Name: "test", dir: dir}
+	err := coll.openDataFiles()
+	if err == nil {
+		err = coll.openWriteAheadLog()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll.idIndex = btree.New(2)
+	err = coll.loadSecondaryIndexDefinitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := coll.loadIdIndexCheckpoint()
+	if !loaded || err != nil {
+		closeTestCollection(t, coll)
+		t.Fatalf("checkpoint wasn't loaded: %v", err)
+	}
+	return coll
+}
+
+func TestCheckpointCoversSecondaryIndexes(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	createTestIndex(t, coll, "n")
+	applyTestWrite(t, coll, InsertWrite, 1, `{"_id":1,"n":[1,2]}`)
+	applyTestWrite(t, coll, InsertWrite, 2, `{"_id":2,"n":{"deep":true}}`)
+	applyTestWrite(t, coll, InsertWrite, 3, `{"_id":3}`)
+	insertTestDocs(t, coll, idRange(10, 100)...)
+	liveBytes := coll.liveBytes
+	closeTestCollection(t, coll)
+
+	coll = openFromCheckpoint(t, dir)
+	defer closeTestCollection(t, coll)
+	si := coll.GetSecondaryIndex("n")
+	expectIds(t, indexedIds(t, si, float64(2)), []int{1})
+	expectIds(t, indexedIds(t, si, []interface{}{float64(1), float64(2)}), []int{1})
+	expectIds(t, indexedIds(t, si, map[string]interface{}{"deep": true}), []int{2})
+	expectIds(t, indexedIds(t, si, nil), []int{3})
+	expectIds(t, indexedIds(t, si, float64(50)), []int{50})
+	if si.Len() != 95 || coll.Len() != 93 || coll.liveBytes != liveBytes {
+		t.Fatalf("%d index entries, %d documents and %d live bytes after loading", si.Len(), coll.Len(), coll.liveBytes)
+	}
+}
+
+func TestCheckpointCatchesUpOnLaterWrites(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	createTestIndex(t, coll, "n")
+	insertTestDocs(t, coll, idRange(0, 50)...)
+	flushTestCollection(t, coll)
+
+	// Go down after a few more writes, leaving the checkpoint behind
+	insertTestDocs(t, coll, idRange(50, 60)...)
+	deleteTestDocs(t, coll, 5)
+	applyTestWrite(t, coll, UpdateWrite, 7, `{"_id":7,"n":700}`)
+	crashDir := t.TempDir()
+	copyDir(t, dir, crashDir)
+
+	recovered := openFromCheckpoint(t, crashDir)
+	defer closeTestCollection(t, recovered)
+	si := recovered.GetSecondaryIndex("n")
+	expectIds(t, indexedIds(t, si, float64(5)), []int{})
+	expectIds(t, indexedIds(t, si, float64(7)), []int{})
+	expectIds(t, indexedIds(t, si, float64(700)), []int{7})
+	expectIds(t, indexedIds(t, si, float64(55)), []int{55})
+	if si.Len() != 59 || recovered.Len() != 59 {
+		t.Fatalf("%d index entries and %d documents after catching up", si.Len(), recovered.Len())
+	}
+}
+
+func TestStaleSecondaryCheckpointFallsBackToScan(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	createTestIndex(t, coll, "n")
+	insertTestDocs(t, coll, idRange(0, 20)...)
+	closeTestCollection(t, coll)
+	stale, err := ioutil.ReadFile(filesystem.SecondaryIndexCheckpointPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coll = openTestCollection(t, dir)
+	deleteTestDocs(t, coll, idRange(0, 10)...)
+	closeTestCollection(t, coll)
+	// As if we went down between writing the two checkpoints
+	err = ioutil.WriteFile(filesystem.SecondaryIndexCheckpointPath(dir), stale, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coll = openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	si := coll.GetSecondaryIndex("n")
+	expectIds(t, indexedIds(t, si, float64(3)), []int{})
+	if si.Len() != 10 || coll.Len() != 10 {
+		t.Fatalf("%d index entries and %d documents", si.Len(), coll.Len())
+	}
+}
@@ -3,40 +3,86 @@ package memory
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"os"
+	"sync"
 
 	"github.com/edsrzf/mmap-go"
-	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/gamechanger/gcdb/wal"
 	"github.com/google/btree"
 )
 
 const (
 	DataStartOffset = uint32(1 + 4 + 8)
+	// Size of the header of every record we write
+	RecordHeaderSize = uint32(1 + 8 + 8 + 4 + 4)
 )
 
+// What the first byte of a data file says about it. Every time the
+// layout of a record changes it gets a new format, and files in the
+// older ones stay readable so they can be upgraded.
+const (
+	formatUninitialized = byte(0)
+	// No checksum and no created version
+	formatOriginal = byte(1)
+	// Checksummed, but no created version
+	formatChecksummed = byte(2)
+	formatVersioned   = byte(3)
+)
+
+// Where the fields of a record header are in each format.
+// Zero for a field the format doesn't have.
+type recordLayout struct {
+	headerSize uint32
+	createdAt  uint32
+	lengthAt   uint32
+	checksumAt uint32
+}
+
+var recordLayouts = map[byte]recordLayout{
+	formatOriginal:    {headerSize: 1 + 8 + 4, lengthAt: 1 + 8},
+	formatChecksummed: {headerSize: 1 + 8 + 4 + 4, lengthAt: 1 + 8, checksumAt: 1 + 8 + 4},
+	formatVersioned:   {headerSize: RecordHeaderSize, createdAt: 1 + 8, lengthAt: 1 + 8 + 8, checksumAt: 1 + 8 + 8 + 4},
+}
+
 type MappedDataFile struct {
 	initialized bool
+	format      byte
+	number      uint32
 	offset      uint32
 	version     uint64
+	file        *os.File
 	mappedFile  *mmap.MMap
 }
 
+// Where a record lives across the whole set of data files
+type Location struct {
+	File   uint32
+	Offset uint32
+}
+
 type IdUnmarshaller struct {
 	Id int `json:"_id"`
 }
 
 type IndexSparseDocument struct {
-	Offset uint32
-	Id     int
+	Location Location
+	Id       int
 }
 
 type Document struct {
-	Document   *[]byte
-	Offset     uint32 // offset of the entire document, not the data segment
-	NextOffset uint32
-	deleted    bool
-	version    uint64
+	Document       *[]byte
+	Location       Location // location of the entire document, not the data segment
+	Next           Location
+	deleted        bool
+	deletedVersion uint64
+	createdVersion uint64
+	headerSize     uint32
 }
 
 // It's weird that this is in this file, but
@@ -45,138 +91,371 @@ func (isd IndexSparseDocument) Less(than btree.Item) bool {
 	return isd.Id < than.(IndexSparseDocument).Id
 }
 
-var currentDataFile *MappedDataFile
-var idIndex *btree.BTree
+// A collection is a named set of documents with its own _id space.
+// Each one keeps its data files, write-ahead log and indexes
+// in its own directory and shares nothing with the others.
+type Collection struct {
+	Name             string
+	dir              string
+	dataFiles        []*MappedDataFile
+	currentDataFile  *MappedDataFile
+	idIndex          *btree.BTree
+	secondaryIndexes map[string]*SecondaryIndex
+	writeAheadLog    *wal.Log
+	// Bytes taken up by records that haven't been deleted,
+	// the rest of the used space can be reclaimed by compaction
+	liveBytes uint64
+	// How many cursors have pinned a snapshot at each version. Cursors
+	// finish with their snapshots from getmores running side by side,
+	// so this has a lock of its own.
+	pinLock        sync.Mutex
+	pinnedVersions map[uint64]int
+	// The oldest version whose history hasn't been compacted away
+	horizon uint64
+	dropped bool
+	closed  bool
+	// Set if the collection can't be used until the server restarts
+	failed error
+}
+
+// Open the collection stored in dir, creating it if it's new, and
+// get it ready to serve: finish any interrupted compaction, map the
+// data files, replay the write-ahead log and build the indexes
+func openCollection(name, dir string) (*Collection, error) {
+	err := filesystem.EnsureDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	coll := &Collection{Name: name, dir: dir}
+	err = coll.openDataFiles()
+	if err != nil {
+		coll.close()
+		return nil, err
+	}
+	if coll.hasUnversionedDataFiles() {
+		err = coll.checkUpgradable()
+		if err != nil {
+			coll.close()
+			return nil, err
+		}
+	}
+	err = coll.openWriteAheadLog()
+	if err != nil {
+		coll.close()
+		return nil, err
+	}
+	err = coll.initializeIndices()
+	if err != nil {
+		coll.close()
+		return nil, err
+	}
+	err = coll.loadHorizon()
+	if err != nil {
+		coll.close()
+		return nil, err
+	}
+	if coll.hasUnversionedDataFiles() {
+		err = coll.upgradeDataFiles()
+		if err != nil {
+			coll.close()
+			return nil, err
+		}
+	}
+	return coll, nil
+}
+
+// Map every data file on disk, making the last one current
+func (coll *Collection) openDataFiles() error {
+	err := filesystem.RecoverCompaction(coll.dir)
+	if err != nil {
+		return err
+	}
+	nums, err := filesystem.DataFileNumbers(coll.dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		mdf, err := coll.openMappedDataFile(num)
+		if err != nil {
+			return err
+		}
+		coll.dataFiles = append(coll.dataFiles, mdf)
+	}
+	coll.currentDataFile = coll.dataFiles[len(coll.dataFiles)-1]
+	return nil
+}
+
+// Checkpoint and unmap everything. Callers must hold the write lock.
+func (coll *Collection) close() error {
+	var err error
+	if coll.idIndex != nil && coll.writeAheadLog != nil {
+		err = coll.checkpoint()
+	}
+	if coll.writeAheadLog != nil {
+		if closeErr := coll.writeAheadLog.Close(); err == nil {
+			err = closeErr
+		}
+		coll.writeAheadLog = nil
+	}
+	closeDataFiles(coll.dataFiles)
+	coll.dataFiles = nil
+	coll.currentDataFile = nil
+	return err
+}
+
+func (coll *Collection) checkOpen() error {
+	if coll.dropped {
+		return dberror.New(dberror.NotFound, fmt.Sprintf("Collection %s was dropped", coll.Name))
+	}
+	if coll.closed {
+		return dberror.New(dberror.Internal, fmt.Sprintf("Collection %s is closed, the server is shutting down", coll.Name))
+	}
+	if coll.failed != nil {
+		return dberror.New(dberror.Internal, fmt.Sprintf("Collection %s is unavailable until the server restarts: %v", coll.Name, coll.failed))
+	}
+	return nil
+}
 
-func InitializeIndices() {
-	log.Println("Building B-tree index on ID")
+func (coll *Collection) openMappedDataFile(fileNum int) (*MappedDataFile, error) {
+	return openMappedDataFileAtPath(fileNum, filesystem.DataFilePath(coll.dir, fileNum))
+}
 
-	idIndex = btree.New(2)
+func openMappedDataFileAtPath(fileNum int, path string) (*MappedDataFile, error) {
+	file, err := filesystem.EnsureDataFileAtPath(path)
+	if err != nil {
+		return nil, err
+	}
+	mappedFile, err := mmap.Map(file, mmap.RDWR, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	mdf, err := NewMappedDataFile(uint32(fileNum), &mappedFile)
+	if err != nil {
+		mappedFile.Unmap()
+		file.Close()
+		return nil, errors.New(fmt.Sprintf("%s: %v", path, err))
+	}
+	mdf.file = file
+	return mdf, nil
+}
+
+// Allocate the next data.N file and start writing into it.
+// The new file picks up the op version where the old one left off.
+func (coll *Collection) rollOverCurrentDataFile() error {
+	previous := coll.currentDataFile
+	err := previous.Flush()
+	if err != nil {
+		return err
+	}
+	mdf, err := coll.openMappedDataFile(int(previous.number) + 1)
+	if err != nil {
+		return err
+	}
+	if mdf.version < previous.version {
+		mdf.version = previous.version
+		mdf.WriteVersionHeader()
+		err = mdf.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	logging.Infof("Data file %s/data.%d is full, rolled over to data.%d", coll.Name, previous.number, mdf.number)
+	coll.dataFiles = append(coll.dataFiles, mdf)
+	coll.currentDataFile = mdf
+	return nil
+}
+
+func FirstLocation() Location {
+	return Location{File: 0, Offset: DataStartOffset}
+}
+
+func (coll *Collection) initializeIndices() error {
+	coll.idIndex = btree.New(2)
+	coll.liveBytes = 0
+	err := coll.loadSecondaryIndexDefinitions()
+	if err != nil {
+		return err
+	}
+
+	loaded, err := coll.loadIdIndexCheckpoint()
+	if err != nil {
+		logging.Infof("Ignoring index checkpoints for %s: %v", coll.Name, err)
+	}
+	if loaded {
+		return nil
+	}
+	coll.idIndex = btree.New(2)
+	coll.liveBytes = 0
+	for _, si := range coll.secondaryIndexes {
+		si.tree = btree.New(2)
+	}
+
+	logging.Infof("Building B-tree index on ID for %s", coll.Name)
+	numDocs, err := coll.catchUpIdIndex(FirstLocation())
+	if err != nil {
+		return err
+	}
+	logging.Infoln(fmt.Sprintf("Index build successful, read %d documents", numDocs))
+	return nil
+}
+
+// Add everything from the given location onwards to the index
+func (coll *Collection) catchUpIdIndex(from Location) (int, error) {
 	resultChannel := make(chan *IndexSparseDocument, 100)
-	go ScanForIndexBuild(resultChannel)
+	errChannel := make(chan error, 1)
+	go func() {
+		errChannel <- coll.scanForIndexBuildFrom(from, resultChannel)
+	}()
 	numDocs := 0
 	for doc := range resultChannel {
-		UpdateIndexFromSparseDocument(doc)
+		coll.UpdateIndexFromSparseDocument(doc)
 		numDocs++
 	}
-
-	log.Println(fmt.Sprintf("Index build successful, read %d documents", numDocs))
+	return numDocs, <-errChannel
 }
 
-func UpdateIndex(id int, offset uint32) {
-	doc := IndexSparseDocument{Id: id, Offset: offset}
-	UpdateIndexFromSparseDocument(&doc)
+func (coll *Collection) UpdateIndex(id int, location Location) {
+	doc := IndexSparseDocument{Id: id, Location: location}
+	coll.UpdateIndexFromSparseDocument(&doc)
 }
 
-func DeleteFromIndex(id int) {
-	doc := IndexSparseDocument{Id: id, Offset: 0}
-	idIndex.Delete(doc)
+func (coll *Collection) DeleteFromIndex(id int) {
+	doc := IndexSparseDocument{Id: id}
+	coll.idIndex.Delete(doc)
 }
 
-func UpdateIndexFromSparseDocument(doc *IndexSparseDocument) {
-	idIndex.ReplaceOrInsert(*doc)
+func (coll *Collection) UpdateIndexFromSparseDocument(doc *IndexSparseDocument) {
+	coll.idIndex.ReplaceOrInsert(*doc)
 }
 
-func LookupOffsetForIdInIndex(id int) uint32 {
-	item := idIndex.Get(IndexSparseDocument{Id: id, Offset: 0})
+func (coll *Collection) LookupLocationForIdInIndex(id int) (Location, bool) {
+	item := coll.idIndex.Get(IndexSparseDocument{Id: id})
 	if item == nil {
-		return 0
+		return Location{}, false
 	}
-	return item.(IndexSparseDocument).Offset
+	return item.(IndexSparseDocument).Location, true
+}
+
+func (coll *Collection) IdExistsInIndex(id int) bool {
+	return coll.idIndex.Get(IndexSparseDocument{Id: id}) != nil
 }
 
-func IdExistsInIndex(id int) bool {
-	return idIndex.Get(IndexSparseDocument{Id: id, Offset: 0}) != nil
+func (coll *Collection) Len() int {
+	return coll.idIndex.Len()
 }
 
-func Stats() []byte {
-	return []byte(fmt.Sprintf("Documents: %d", idIndex.Len()))
+func (coll *Collection) Stats() []byte {
+	return []byte(fmt.Sprintf("Collection: %s\nDocuments: %d\nData files: %d\nReclaimable bytes: %d\nVersion: %d\nHistory from version: %d",
+		coll.Name, coll.idIndex.Len(), len(coll.dataFiles), coll.ReclaimableBytes(), coll.currentDataFile.version, coll.horizon) + coll.secondaryIndexStats())
 }
 
 // Here's the jank-ass format for the data files
-// First byte: 0 if file has been initialized, 1 otherwise
-// Next eight bytes: uint64 storing current op version
+// Files are named data.0, data.1, ... and a new one is started
+// whenever the current one doesn't have room for the next write
+// First byte: 0 if file hasn't been initialized, otherwise the format
+// of its records, 3 for the one described below. 2 lacks the created
+// version, and 1 lacks that and the checksum too.
 // Next four bytes: uint32 storing latest write offset in file
+// Next eight bytes: uint64 storing current op version
 // Errythang else: Dem datas
 
 // And the format for dem datas is:
 // First byte: 0 if document is current, 1 if deleted
-// Next eight bytes: uint64 of last valid op version for this doc if it's deleted now
-// First four bytes: uint32 storing length of data segment
+// Next eight bytes: uint64 op version that deleted this doc if it's deleted now
+// Next eight bytes: uint64 op version that created this doc
+// Next four bytes: uint32 storing length of data segment
+// Next four bytes: uint32 CRC-32 (IEEE) of everything after the deleted
+// version up to here, plus the data segment
 // Following bytes: data segment
 
-func NewMappedDataFile(mappedFile *mmap.MMap) *MappedDataFile {
-	new := &MappedDataFile{initialized: false, offset: 0, mappedFile: mappedFile}
-	new.Initialize()
-	return new
-}
-
-func SetCurrentDataFile(mdf *MappedDataFile) {
-	locks.StopTheWorld()
-	defer locks.UnstopTheWorld()
-	currentDataFile = mdf
+func NewMappedDataFile(number uint32, mappedFile *mmap.MMap) (*MappedDataFile, error) {
+	new := &MappedDataFile{initialized: false, number: number, offset: 0, mappedFile: mappedFile}
+	err := new.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	return new, nil
 }
 
-func WriteDocumentToCurrentFile(id int, data []byte) {
-	headerBytes := make([]byte, 1+8+4)
-	binary.BigEndian.PutUint32(headerBytes[1+8:], uint32(len(data)))
-	offset := currentDataFile.offset
-	currentDataFile.WriteBytes(headerBytes)
-	currentDataFile.WriteBytes(data)
-	UpdateIndex(id, offset)
+func (coll *Collection) dataFileForLocation(location Location) (*MappedDataFile, error) {
+	if int(location.File) >= len(coll.dataFiles) {
+		return nil, errors.New(fmt.Sprintf("No data file numbered %d in %s", location.File, coll.Name))
+	}
+	return coll.dataFiles[location.File], nil
 }
 
-// Delete the document at the given offset
-// Right now this is being chained together by a scan at the caller level
-// Seems kinda dirty /shrug
-func DeleteDocumentFromCurrentDataFileAtOffset(id int, offset uint32) error {
-	versionBytes := make([]byte, 8)
-	currentDataFile.WriteBytesAtOffset([]byte{1}, offset)
-	binary.BigEndian.PutUint64(versionBytes, currentDataFile.version)
-	currentDataFile.WriteBytesAtOffset(versionBytes, offset+1)
-	currentDataFile.IncrementVersion()
-	DeleteFromIndex(id)
-	return nil
+func (coll *Collection) ScanForIndexBuild(resultChannel chan *IndexSparseDocument) error {
+	return coll.scanForIndexBuildFrom(FirstLocation(), resultChannel)
 }
 
-func ScanForIndexBuild(resultChannel chan *IndexSparseDocument) {
+// Stops at the first document that can't be indexed, returning where it is
+func (coll *Collection) scanForIndexBuildFrom(from Location, resultChannel chan *IndexSparseDocument) error {
 	incomingChannel := make(chan *Document, 50)
 	stopChannel := make(chan bool, 1)
 	defer close(resultChannel)
-	go currentDataFile.CollectionScan(DataStartOffset, incomingChannel, stopChannel)
+	go coll.CollectionScan(from, incomingChannel, stopChannel)
 
 	idUnmarshalStruct := IdUnmarshaller{}
 	for doc := range incomingChannel {
 		err := json.Unmarshal(*doc.Document, &idUnmarshalStruct)
+		if err == nil {
+			err = coll.addToSecondaryIndexes(idUnmarshalStruct.Id, *doc.Document, doc.Location)
+		}
 		if err != nil {
-			panic(err)
+			stopScan(incomingChannel, stopChannel)
+			return &CorruptRecordError{
+				Location: doc.Location,
+				Reason:   fmt.Sprintf("checksum is fine but the document isn't valid: %v", err)}
 		}
-		resultChannel <- &IndexSparseDocument{Offset: doc.Offset, Id: idUnmarshalStruct.Id}
+		coll.liveBytes += doc.size()
+		resultChannel <- &IndexSparseDocument{Location: doc.Location, Id: idUnmarshalStruct.Id}
 	}
-
+	return nil
 }
 
-func IndexScanCurrentDataFileForId(id int) (*Document, error) {
-	offset := LookupOffsetForIdInIndex(id)
-	if offset == uint32(0) {
+func (coll *Collection) IndexScanForId(id int) (*Document, error) {
+	location, ok := coll.LookupLocationForIdInIndex(id)
+	if !ok {
 		return nil, nil
 	}
-	doc, _ := currentDataFile.ReadDocumentAtOffset(offset)
+	return coll.ReadDocumentAtLocation(location)
+}
+
+func (coll *Collection) ReadDocumentAtLocation(location Location) (*Document, error) {
+	err := coll.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	mdf, err := coll.dataFileForLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	doc, _, err := mdf.ReadDocumentAtOffset(location.Offset)
+	if err != nil {
+		return nil, err
+	}
 	return doc, nil
 }
 
-func CollectionScanCurrentDataFileForId(id int) (*Document, error) {
+func (coll *Collection) CollectionScanForId(id int) (*Document, error) {
+	return coll.collectionScanForIdIn(id, coll.Snapshot())
+}
+
+func (coll *Collection) collectionScanForIdIn(id int, snapshot Snapshot) (*Document, error) {
 	// TODO: Think we can parallelize the JSON encoding part of this more
 
 	resultChannel := make(chan *Document, 50)
 	// need a buffer here since receiver might be dead by the
 	// time we tell it to close. channel will get GC'd in that case anyway
 	stopChannel := make(chan bool, 1)
-	defer func() {
-		stopChannel <- true
-	}()
 
-	go currentDataFile.CollectionScan(DataStartOffset, resultChannel, stopChannel)
+	err := coll.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	go coll.CollectionScanSnapshot(FirstLocation(), snapshot, resultChannel, stopChannel)
+	defer stopScan(resultChannel, stopChannel)
 	idUnmarshalStruct := IdUnmarshaller{} // faster, deserialize less, reuse struct
 	for doc := range resultChannel {
 		err := json.Unmarshal(*doc.Document, &idUnmarshalStruct)
@@ -190,14 +469,16 @@ func CollectionScanCurrentDataFileForId(id int) (*Document, error) {
 	return nil, nil
 }
 
-func CollectionScanCurrentDataFileFromOffset(offset uint32, docsToReturn int) ([]*Document, error) {
+// Up to docsToReturn documents in the snapshot starting at location
+func (coll *Collection) CollectionScanFromLocation(location Location, snapshot Snapshot, docsToReturn int) ([]*Document, error) {
+	err := coll.checkOpen()
+	if err != nil {
+		return nil, err
+	}
 	resultChannel := make(chan *Document, 50)
 	stopChannel := make(chan bool, 1)
-	defer func() {
-		stopChannel <- true
-	}()
-
-	go currentDataFile.CollectionScan(offset, resultChannel, stopChannel)
+	go coll.CollectionScanSnapshot(location, snapshot, resultChannel, stopChannel)
+	defer stopScan(resultChannel, stopChannel)
 	docs := make([]*Document, 0, docsToReturn)
 	for doc := range resultChannel {
 		docs = append(docs, doc)
@@ -208,62 +489,97 @@ func CollectionScanCurrentDataFileFromOffset(offset uint32, docsToReturn int) ([
 	return docs, nil
 }
 
-func FlushCurrentFile() error {
-	return currentDataFile.Flush()
+// Flush every data file, after which the write-ahead log can be emptied
+func (coll *Collection) FlushCurrentFile() error {
+	err := coll.checkOpen()
+	if err != nil {
+		return err
+	}
+	return coll.checkpoint()
 }
 
-func (mdf *MappedDataFile) Initialize() {
+func (mdf *MappedDataFile) Initialize() error {
 	initByte := mdf.ReadBytesAtOffset(1, 0)
-	if (*initByte)[0] != 0 { // previously initialized
+	if (*initByte)[0] != formatUninitialized { // previously initialized
 		mdf.initialized = true
-		offsetBytes := mdf.ReadBytesAtOffset(4, 1)
-		mdf.offset = binary.BigEndian.Uint32(*offsetBytes)
-		versionBytes := mdf.ReadBytesAtOffset(8, 5)
-		mdf.version = binary.BigEndian.Uint64(*versionBytes)
-		return
+		return mdf.readHeader()
 	}
+	mdf.format = formatVersioned
 	mdf.offset = DataStartOffset
 	mdf.version = uint64(1)
 	mdf.WriteOffsetHeader()
 	mdf.WriteVersionHeader()
-	mdf.WriteBytesAtOffset([]byte{1}, 0)
+	mdf.WriteBytesAtOffset([]byte{formatVersioned}, 0)
 	mdf.initialized = true
-	mdf.Flush()
+	return mdf.Flush()
+}
+
+// Guessing at the layout of a file we don't know would
+// have us reading garbage, or worse, writing it
+func (mdf *MappedDataFile) readHeader() error {
+	mdf.format = (*mdf.ReadBytesAtOffset(1, 0))[0]
+	if _, ok := recordLayouts[mdf.format]; !ok {
+		return errors.New(fmt.Sprintf("data.%d has unknown format %d", mdf.number, mdf.format))
+	}
+	offsetBytes := mdf.ReadBytesAtOffset(4, 1)
+	mdf.offset = binary.BigEndian.Uint32(*offsetBytes)
+	versionBytes := mdf.ReadBytesAtOffset(8, 5)
+	mdf.version = binary.BigEndian.Uint64(*versionBytes)
+	return nil
 }
 
 func (mdf *MappedDataFile) Flush() error {
 	return mdf.mappedFile.Flush()
 }
 
+func (mdf *MappedDataFile) Close() error {
+	err := mdf.mappedFile.Unmap()
+	if err != nil {
+		return err
+	}
+	if mdf.file != nil {
+		return mdf.file.Close()
+	}
+	return nil
+}
+
 func (mdf *MappedDataFile) IncrementVersion() {
 	mdf.version += uint64(1)
 	mdf.WriteVersionHeader()
 }
 
 func (mdf *MappedDataFile) WriteVersionHeader() {
-	versionBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(versionBytes, mdf.version)
-	mdf.WriteBytesAtOffset(versionBytes, 5)
+	mdf.WriteBytesAtOffset(versionHeaderBytes(mdf.version), 5)
 }
 
 func (mdf *MappedDataFile) WriteOffsetHeader() {
+	mdf.WriteBytesAtOffset(offsetHeaderBytes(mdf.offset), 1)
+}
+
+func versionHeaderBytes(version uint64) []byte {
+	versionBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(versionBytes, version)
+	return versionBytes
+}
+
+func offsetHeaderBytes(offset uint32) []byte {
 	offsetBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(offsetBytes, mdf.offset)
-	mdf.WriteBytesAtOffset(offsetBytes, 1)
+	binary.BigEndian.PutUint32(offsetBytes, offset)
+	return offsetBytes
 }
 
 func (mdf *MappedDataFile) ReadBytesAtOffset(numBytes, offset uint32) *[]byte {
 	new := make([]byte, numBytes)
-	for idx := range new {
-		new[idx] = (*mdf.mappedFile)[offset+uint32(idx)]
-	}
+	copy(new, (*mdf.mappedFile)[offset:offset+numBytes])
 	return &new
 }
 
 func (mdf *MappedDataFile) WriteBytesAtOffset(data []byte, offset uint32) {
-	for idx := range data {
-		(*mdf.mappedFile)[offset+uint32(idx)] = data[idx]
-	}
+	copy((*mdf.mappedFile)[offset:offset+uint32(len(data))], data)
+}
+
+func (mdf *MappedDataFile) HasRoomFor(numBytes uint64) bool {
+	return uint64(mdf.offset)+numBytes <= uint64(len(*mdf.mappedFile))
 }
 
 func (mdf *MappedDataFile) WriteBytes(data []byte) {
@@ -272,41 +588,161 @@ func (mdf *MappedDataFile) WriteBytes(data []byte) {
 	mdf.WriteOffsetHeader()
 }
 
-func (mdf *MappedDataFile) ReadDocumentAtOffset(offset uint32) (document *Document, nextOffset uint32) {
-	headerBytes := mdf.ReadBytesAtOffset(1+8+4, offset)
-	docVersion := binary.BigEndian.Uint64((*headerBytes)[1 : 1+8])
-	docLength := binary.BigEndian.Uint32((*headerBytes)[1+8:])
-	nextOffset = offset + 1 + 8 + 4 + docLength
+// Write a fresh, undeleted record at the end of this file
+// without going through the write-ahead log
+func (mdf *MappedDataFile) appendRecord(data []byte, createdVersion uint64) Location {
+	location := Location{File: mdf.number, Offset: mdf.offset}
+	mdf.WriteBytes(encodeRecord(data, createdVersion))
+	return location
+}
+
+func encodeRecord(data []byte, createdVersion uint64) []byte {
+	record := make([]byte, RecordHeaderSize+uint32(len(data)))
+	binary.BigEndian.PutUint64(record[1+8:], createdVersion)
+	binary.BigEndian.PutUint32(record[1+8+8:], uint32(len(data)))
+	copy(record[RecordHeaderSize:], data)
+	binary.BigEndian.PutUint32(record[1+8+8+4:], recordChecksum(record[1+8:1+8+8+4], data))
+	return record
+}
+
+func recordChecksum(headerBytes, data []byte) uint32 {
+	crc := crc32.ChecksumIEEE(headerBytes)
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
+
+func (mdf *MappedDataFile) recordLayout() recordLayout {
+	return recordLayouts[mdf.format]
+}
+
+func (mdf *MappedDataFile) recordHeaderSize() uint32 {
+	return mdf.recordLayout().headerSize
+}
+
+type CorruptRecordError struct {
+	Location Location
+	Reason   string
+	// Zero if the record's length can't be trusted, in which
+	// case there is no telling where the next record starts
+	NextOffset uint32
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("Corrupt record in data.%d at offset %d: %s", e.Location.File, e.Location.Offset, e.Reason)
+}
+
+func (mdf *MappedDataFile) ReadDocumentAtOffset(offset uint32) (document *Document, nextOffset uint32, err error) {
+	location := Location{File: mdf.number, Offset: offset}
+	layout := mdf.recordLayout()
+	headerSize := layout.headerSize
+	if uint64(offset)+uint64(headerSize) > uint64(mdf.offset) {
+		return nil, 0, &CorruptRecordError{Location: location, Reason: "header runs past the end of the data"}
+	}
+	headerBytes := *mdf.ReadBytesAtOffset(headerSize, offset)
+	docLength := binary.BigEndian.Uint32(headerBytes[layout.lengthAt:])
+	if uint64(offset)+uint64(headerSize)+uint64(docLength) > uint64(mdf.offset) {
+		return nil, 0, &CorruptRecordError{Location: location, Reason: fmt.Sprintf("length %d runs past the end of the data", docLength)}
+	}
+	nextOffset = offset + headerSize + docLength
+	data := mdf.ReadBytesAtOffset(docLength, offset+headerSize)
+	if layout.checksumAt != 0 && recordChecksum(headerBytes[1+8:layout.checksumAt], *data) != binary.BigEndian.Uint32(headerBytes[layout.checksumAt:]) {
+		return nil, nextOffset, &CorruptRecordError{Location: location, Reason: "checksum mismatch", NextOffset: nextOffset}
+	}
 	doc := Document{
-		Document:   mdf.ReadBytesAtOffset(docLength, offset+1+8+4),
-		Offset:     offset,
-		NextOffset: nextOffset,
-		deleted:    (*headerBytes)[0] == 1,
-		version:    docVersion}
-	return &doc, nextOffset
+		Document:       data,
+		Location:       location,
+		Next:           Location{File: mdf.number, Offset: nextOffset},
+		deleted:        headerBytes[0] == 1,
+		deletedVersion: binary.BigEndian.Uint64(headerBytes[1 : 1+8]),
+		headerSize:     headerSize}
+	if layout.createdAt != 0 {
+		doc.createdVersion = binary.BigEndian.Uint64(headerBytes[layout.createdAt:])
+	}
+	return &doc, nextOffset, nil
 }
 
-func (mdf *MappedDataFile) CollectionScan(fromOffset uint32, outputChannel chan *Document, stopChannel chan bool) {
+// Size of the whole record on disk, header included
+func (doc *Document) size() uint64 {
+	return uint64(doc.headerSize) + uint64(len(*doc.Document))
+}
+
+// Scan every data file starting at the given location
+func (coll *Collection) CollectionScan(from Location, outputChannel chan *Document, stopChannel chan bool) {
 	// This is taking a snapshot at the time the scan starts
 	// We will not scan any documents inserted after we record this
 	// Additionally, any documents deleted before the current DB version
 	// will not be returned
+	coll.CollectionScanSnapshot(from, coll.Snapshot(), outputChannel, stopChannel)
+}
+
+// Same as CollectionScan, but for a snapshot taken earlier
+func (coll *Collection) CollectionScanSnapshot(from Location, snapshot Snapshot, outputChannel chan *Document, stopChannel chan bool) {
+	coll.scanUntil(from, snapshot.End, snapshot.visible, outputChannel, stopChannel)
+}
+
+// Send every record between from and end that keep says to.
+// The output channel gets closed however the scan ends.
+func (coll *Collection) scanUntil(from, end Location, keep func(doc *Document) bool, outputChannel chan *Document, stopChannel chan bool) {
+	defer close(outputChannel)
+	for fileNum := from.File; fileNum <= end.File; fileNum++ {
+		mdf := coll.dataFiles[fileNum]
+		fromOffset := DataStartOffset
+		if fileNum == from.File {
+			fromOffset = from.Offset
+		}
+		stopOffset := mdf.offset
+		if fileNum == end.File && end.Offset < stopOffset {
+			stopOffset = end.Offset
+		}
+		if !mdf.scan(fromOffset, stopOffset, keep, outputChannel, stopChannel) {
+			return
+		}
+	}
+}
+
+func (mdf *MappedDataFile) CollectionScan(fromOffset uint32, outputChannel chan *Document, stopChannel chan bool) {
+	defer close(outputChannel)
+	mdf.scan(fromOffset, mdf.offset, Snapshot{Version: mdf.version}.visible, outputChannel, stopChannel)
+}
+
+// Tell a scan to stop and wait until it has, so it's not still reading
+// the data files after the caller lets go of the write lock
+func stopScan(outputChannel chan *Document, stopChannel chan bool) {
+	stopChannel <- true
+	for range outputChannel {
+	}
+}
+
+// Returns false if the scan was told to stop early
+func (mdf *MappedDataFile) scan(fromOffset, stopOffset uint32, keep func(doc *Document) bool, outputChannel chan *Document, stopChannel chan bool) bool {
 	currentOffset := fromOffset
-	currentVersion := currentDataFile.version
-	stopOffset := mdf.offset
 	for currentOffset < stopOffset {
 		select {
 		case <-stopChannel:
-			log.Println("CollectionScan got stop")
-			return
+			logging.Debugln("CollectionScan got stop")
+			return false
 		default:
-			document, nextOffset := mdf.ReadDocumentAtOffset(currentOffset)
+			document, nextOffset, err := mdf.ReadDocumentAtOffset(currentOffset)
+			if err != nil {
+				// Skip what we can't read rather than taking the server down,
+				// the verify command will point it out
+				logging.Errorln(err)
+				if nextOffset == 0 {
+					return true
+				}
+				currentOffset = nextOffset
+				continue
+			}
 			currentOffset = nextOffset
-			if document.deleted && document.version < currentVersion {
+			if !keep(document) {
 				continue
 			}
-			outputChannel <- document
+			select {
+			case outputChannel <- document:
+			case <-stopChannel:
+				logging.Debugln("CollectionScan got stop")
+				return false
+			}
 		}
 	}
-	close(outputChannel)
+	return true
 }
@@ -0,0 +1,160 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+// Small data files so a few dozen documents are enough to roll over
+const testDataFileSize = 4096
+
+func TestMain(m *testing.M) {
+	filesystem.SetDataFileSize(testDataFileSize)
+	SetWALSyncPolicy(wal.SyncNever, 0)
+	StartWriter()
+	os.Exit(m.Run())
+}
+
+func openTestCollection(t *testing.T, dir string) *Collection {
+	t.Helper()
+	coll, err := openCollection("test", dir)
+	if err != nil {
+		t.Fatalf("opening collection in %s: %v", dir, err)
+	}
+	return coll
+}
+
+func closeTestCollection(t *testing.T, coll *Collection) {
+	t.Helper()
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	err := coll.close()
+	if err != nil {
+		t.Fatalf("closing collection: %v", err)
+	}
+}
+
+func testDoc(id int) []byte {
+	return []byte(fmt.Sprintf(`{"_id":%d,"n":%d}`, id, id))
+}
+
+func insertTestDocs(t *testing.T, coll *Collection, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		err := coll.ApplyWrites([]Write{{Kind: InsertWrite, Id: id, Data: testDoc(id)}})
+		if err != nil {
+			t.Fatalf("inserting %d: %v", id, err)
+		}
+	}
+}
+
+func deleteTestDocs(t *testing.T, coll *Collection, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		err := coll.ApplyWrites([]Write{{Kind: DeleteWrite, Id: id}})
+		if err != nil {
+			t.Fatalf("deleting %d: %v", id, err)
+		}
+	}
+}
+
+func idRange(from, to int) []int {
+	ids := make([]int, 0, to-from)
+	for id := from; id < to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Reads under the write lock like the api does
+func findTestDoc(t *testing.T, coll *Collection, id int) map[string]interface{} {
+	t.Helper()
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	doc, err := coll.IndexScanForId(id)
+	if err != nil {
+		t.Fatalf("finding %d: %v", id, err)
+	}
+	if doc == nil {
+		return nil
+	}
+	return decodeTestDoc(t, *doc.Document)
+}
+
+func decodeTestDoc(t *testing.T, data []byte) map[string]interface{} {
+	t.Helper()
+	decoded := make(map[string]interface{})
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	return decoded
+}
+
+// The _ids of every document a full scan turns up, in order
+func scanTestIds(t *testing.T, coll *Collection) []int {
+	t.Helper()
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	return scanIdsIn(t, coll, coll.Snapshot())
+}
+
+func scanIdsIn(t *testing.T, coll *Collection, snapshot Snapshot) []int {
+	t.Helper()
+	docs, err := coll.CollectionScanFromLocation(FirstLocation(), snapshot, 1<<20)
+	if err != nil {
+		t.Fatalf("scanning: %v", err)
+	}
+	ids := make([]int, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, idOf(decodeTestDoc(t, *doc.Document)))
+	}
+	return ids
+}
+
+func expectIds(t *testing.T, got, want []int) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got ids %v, want %v", got, want)
+	}
+}
+
+func TestWritesRollOverToNewDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	ids := idRange(0, 300)
+	insertTestDocs(t, coll, ids...)
+	if len(coll.dataFiles) < 3 {
+		t.Fatalf("only %d data files after filling several", len(coll.dataFiles))
+	}
+	for idx, mdf := range coll.dataFiles {
+		if mdf.number != uint32(idx) || uint64(mdf.offset) > testDataFileSize {
+			t.Fatalf("data.%d is number %d and ends at %d", idx, mdf.number, mdf.offset)
+		}
+		// Each file carries on from the version the last one left off at
+		if idx > 0 && mdf.version < coll.dataFiles[idx-1].version {
+			t.Fatalf("data.%d is at version %d, behind data.%d", idx, mdf.version, idx-1)
+		}
+	}
+	expectIds(t, scanTestIds(t, coll), ids)
+
+	tooBig := make([]byte, testDataFileSize)
+	err := coll.ApplyWrites([]Write{{Kind: InsertWrite, Id: 1000, Data: tooBig}})
+	if err == nil {
+		t.Fatal("inserted a document bigger than a data file")
+	}
+
+	closeTestCollection(t, coll)
+	coll = openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	expectIds(t, scanTestIds(t, coll), ids)
+	if doc := findTestDoc(t, coll, 299); doc == nil {
+		t.Fatal("lost the last document in the last file")
+	}
+}
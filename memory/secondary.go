@@ -0,0 +1,277 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/gamechanger/gcdb/values"
+	"github.com/google/btree"
+)
+
+// Secondary indexes are B-trees keyed on the value found at a dotted
+// field path, with the _id breaking ties so every entry is unique.
+// Documents missing the field are indexed under null, and arrays are
+// indexed both as a whole and under each of their elements. The paths
+// are saved when an index is created, and the trees are checkpointed
+// along with the _id index, see idcheckpoint.go.
+
+type SecondaryIndexEntry struct {
+	Value    interface{}
+	Id       int
+	Location Location
+}
+
+func (e SecondaryIndexEntry) Less(than btree.Item) bool {
+	other := than.(SecondaryIndexEntry)
+	if c := values.Compare(e.Value, other.Value); c != 0 {
+		return c < 0
+	}
+	return e.Id < other.Id
+}
+
+const minInt = -int(^uint(0)>>1) - 1
+
+type SecondaryIndex struct {
+	Path string
+	tree *btree.BTree
+}
+
+func newSecondaryIndex(path string) *SecondaryIndex {
+	return &SecondaryIndex{Path: path, tree: btree.New(2)}
+}
+
+func (si *SecondaryIndex) entriesFor(id int, doc map[string]interface{}, location Location) []SecondaryIndexEntry {
+	value, _ := values.Lookup(doc, si.Path)
+	entries := []SecondaryIndexEntry{{Value: value, Id: id, Location: location}}
+	if array, ok := value.([]interface{}); ok {
+		for _, element := range array {
+			entries = append(entries, SecondaryIndexEntry{Value: element, Id: id, Location: location})
+		}
+	}
+	return entries
+}
+
+func (si *SecondaryIndex) insert(id int, doc map[string]interface{}, location Location) {
+	for _, entry := range si.entriesFor(id, doc, location) {
+		si.tree.ReplaceOrInsert(entry)
+	}
+}
+
+func (si *SecondaryIndex) remove(id int, doc map[string]interface{}) {
+	for _, entry := range si.entriesFor(id, doc, Location{}) {
+		si.tree.Delete(entry)
+	}
+}
+
+// Call fn for every entry with a value between lower and upper inclusive,
+// in order, until it returns false. Null is a value like any other, so
+// hasLower and hasUpper say whether there's a bound at each end.
+func (si *SecondaryIndex) AscendRange(lower interface{}, hasLower bool, upper interface{}, hasUpper bool, fn func(entry SecondaryIndexEntry) bool) {
+	iterator := func(item btree.Item) bool {
+		entry := item.(SecondaryIndexEntry)
+		if hasUpper && values.Compare(entry.Value, upper) > 0 {
+			return false
+		}
+		return fn(entry)
+	}
+	if !hasLower {
+		si.tree.Ascend(iterator)
+		return
+	}
+	si.tree.AscendGreaterOrEqual(SecondaryIndexEntry{Value: lower, Id: minInt}, iterator)
+}
+
+func (si *SecondaryIndex) Len() int {
+	return si.tree.Len()
+}
+
+// Load the index definitions, the trees get filled in from the
+// checkpoint or the startup scan
+func (coll *Collection) loadSecondaryIndexDefinitions() error {
+	coll.secondaryIndexes = make(map[string]*SecondaryIndex)
+	paths, err := ReadIndexDefinitions(coll.dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		coll.secondaryIndexes[path] = newSecondaryIndex(path)
+	}
+	return nil
+}
+
+// The paths indexed in the collection stored in dir, which
+// can be read whether or not the collection is open
+func ReadIndexDefinitions(dir string) ([]string, error) {
+	paths := make([]string, 0)
+	data, err := ioutil.ReadFile(filesystem.IndexDefinitionsPath(dir))
+	if os.IsNotExist(err) {
+		return paths, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &paths)
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+func (coll *Collection) saveSecondaryIndexDefinitions() error {
+	data, err := json.Marshal(coll.IndexedPaths())
+	if err != nil {
+		return err
+	}
+	return filesystem.WriteFileAtomically(filesystem.IndexDefinitionsPath(coll.dir), data)
+}
+
+func (coll *Collection) IndexedPaths() []string {
+	paths := make([]string, 0, len(coll.secondaryIndexes))
+	for path := range coll.secondaryIndexes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (coll *Collection) GetSecondaryIndex(path string) *SecondaryIndex {
+	return coll.secondaryIndexes[path]
+}
+
+func validateIndexPath(path string) error {
+	if path == "" || path == "_id" {
+		return dberror.New(dberror.BadRequest, "Index path must be a dotted field path other than _id")
+	}
+	for _, piece := range strings.Split(path, ".") {
+		if piece == "" {
+			return dberror.New(dberror.BadRequest, fmt.Sprintf("Invalid index path %s", path))
+		}
+	}
+	return nil
+}
+
+// Build a new index with a full scan. Callers must hold the write lock.
+func (coll *Collection) CreateSecondaryIndex(path string) (int, error) {
+	err := coll.checkOpen()
+	if err != nil {
+		return 0, err
+	}
+	err = validateIndexPath(path)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := coll.secondaryIndexes[path]; ok {
+		return 0, dberror.New(dberror.DuplicateKey, fmt.Sprintf("An index on %s already exists", path))
+	}
+
+	si := newSecondaryIndex(path)
+	resultChannel := make(chan *Document, 50)
+	stopChannel := make(chan bool, 1)
+	go coll.CollectionScan(FirstLocation(), resultChannel, stopChannel)
+	defer stopScan(resultChannel, stopChannel)
+	for doc := range resultChannel {
+		unmarshaled := make(map[string]interface{})
+		err := json.Unmarshal(*doc.Document, &unmarshaled)
+		if err != nil {
+			return 0, err
+		}
+		si.insert(idOf(unmarshaled), unmarshaled, doc.Location)
+	}
+
+	coll.secondaryIndexes[path] = si
+	err = coll.saveSecondaryIndexDefinitions()
+	if err != nil {
+		delete(coll.secondaryIndexes, path)
+		return 0, err
+	}
+	logging.Infof("Built index on %s.%s with %d entries", coll.Name, path, si.Len())
+	return si.Len(), nil
+}
+
+func (coll *Collection) DropSecondaryIndex(path string) error {
+	err := coll.checkOpen()
+	if err != nil {
+		return err
+	}
+	if _, ok := coll.secondaryIndexes[path]; !ok {
+		return dberror.New(dberror.NotFound, fmt.Sprintf("No index on %s in %s", path, coll.Name))
+	}
+	delete(coll.secondaryIndexes, path)
+	return coll.saveSecondaryIndexDefinitions()
+}
+
+func idOf(doc map[string]interface{}) int {
+	id, _ := doc["_id"].(float64)
+	return int(id)
+}
+
+func (coll *Collection) addToSecondaryIndexes(id int, data []byte, location Location) error {
+	doc, err := coll.decodeForSecondaryIndexes(data)
+	if err != nil {
+		return err
+	}
+	coll.insertIntoSecondaryIndexes(id, doc, location)
+	return nil
+}
+
+// Only bother decoding the whole document if there are indexes to
+// maintain, returning nil if there aren't. Writes decode documents
+// while they're planned, so nothing can go wrong updating the indexes
+// once they've been logged.
+func (coll *Collection) decodeForSecondaryIndexes(data []byte) (map[string]interface{}, error) {
+	if len(coll.secondaryIndexes) == 0 {
+		return nil, nil
+	}
+	doc := make(map[string]interface{})
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (coll *Collection) insertIntoSecondaryIndexes(id int, doc map[string]interface{}, location Location) {
+	if doc == nil {
+		return
+	}
+	for _, si := range coll.secondaryIndexes {
+		si.insert(id, doc, location)
+	}
+}
+
+func (coll *Collection) removeFromSecondaryIndexes(id int, doc map[string]interface{}) {
+	if doc == nil {
+		return
+	}
+	for _, si := range coll.secondaryIndexes {
+		si.remove(id, doc)
+	}
+}
+
+func (coll *Collection) relocateSecondaryIndexes(result *CompactionResult) {
+	for _, si := range coll.secondaryIndexes {
+		relocated := btree.New(2)
+		si.tree.Ascend(func(item btree.Item) bool {
+			entry := item.(SecondaryIndexEntry)
+			entry.Location = result.Relocate(entry.Location)
+			relocated.ReplaceOrInsert(entry)
+			return true
+		})
+		si.tree = relocated
+	}
+}
+
+func (coll *Collection) secondaryIndexStats() string {
+	stats := ""
+	for _, path := range coll.IndexedPaths() {
+		stats += fmt.Sprintf("\nIndex %s: %d entries", path, coll.secondaryIndexes[path].Len())
+	}
+	return stats
+}
@@ -0,0 +1,101 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/gamechanger/gcdb/locks"
+)
+
+func createTestIndex(t *testing.T, coll *Collection, path string) *SecondaryIndex {
+	t.Helper()
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	_, err := coll.CreateSecondaryIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coll.GetSecondaryIndex(path)
+}
+
+// The _ids of every entry in the index under value
+func indexedIds(t *testing.T, si *SecondaryIndex, value interface{}) []int {
+	t.Helper()
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	ids := make([]int, 0)
+	si.AscendRange(value, true, value, true, func(entry SecondaryIndexEntry) bool {
+		ids = append(ids, entry.Id)
+		return true
+	})
+	return ids
+}
+
+func applyTestWrite(t *testing.T, coll *Collection, kind WriteKind, id int, data string) {
+	t.Helper()
+	err := coll.ApplyWrites([]Write{{Kind: kind, Id: id, Data: []byte(data)}})
+	if err != nil {
+		t.Fatalf("writing %d: %v", id, err)
+	}
+}
+
+func TestSecondaryIndexFollowsWrites(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	applyTestWrite(t, coll, InsertWrite, 1, `{"_id":1,"a":{"b":"x"}}`)
+	applyTestWrite(t, coll, InsertWrite, 2, `{"_id":2,"a":{"b":["x","y"]}}`)
+	si := createTestIndex(t, coll, "a.b")
+	applyTestWrite(t, coll, InsertWrite, 3, `{"_id":3,"a":{"b":"y"}}`)
+	applyTestWrite(t, coll, InsertWrite, 4, `{"_id":4}`)
+
+	expectIds(t, indexedIds(t, si, "x"), []int{1, 2})
+	expectIds(t, indexedIds(t, si, "y"), []int{2, 3})
+	expectIds(t, indexedIds(t, si, []interface{}{"x", "y"}), []int{2})
+
+	applyTestWrite(t, coll, UpdateWrite, 1, `{"_id":1,"a":{"b":"y"}}`)
+	applyTestWrite(t, coll, DeleteWrite, 2, "")
+	expectIds(t, indexedIds(t, si, "x"), []int{})
+	expectIds(t, indexedIds(t, si, "y"), []int{1, 3})
+
+	// Rebuilt from the data files at startup
+	closeTestCollection(t, coll)
+	coll = openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	si = coll.GetSecondaryIndex("a.b")
+	if si == nil {
+		t.Fatal("index definition wasn't saved")
+	}
+	expectIds(t, indexedIds(t, si, "y"), []int{1, 3})
+	if si.Len() != 3 {
+		t.Fatalf("index has %d entries, want 3", si.Len())
+	}
+}
+
+// Anything that could stop the indexes being updated has
+// to turn up before the write is logged, not after
+func TestUnindexableWriteIsRejectedBeforeLogging(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	si := createTestIndex(t, coll, "n")
+	insertTestDocs(t, coll, 1)
+	logSize := coll.writeAheadLog.Size()
+
+	results, err := coll.ApplyWriteGroups([][]Write{
+		{{Kind: InsertWrite, Id: 2, Data: testDoc(2)}, {Kind: InsertWrite, Id: 3, Data: []byte(`{"_id":3,`)}},
+		{{Kind: InsertWrite, Id: 4, Data: testDoc(4)}},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0] == nil || results[1] != nil {
+		t.Fatalf("got results %v", results)
+	}
+	expectIds(t, scanTestIds(t, coll), []int{1, 4})
+	expectIds(t, indexedIds(t, si, float64(4)), []int{4})
+	if si.Len() != 2 || coll.Len() != 2 {
+		t.Fatalf("%d index entries and %d documents, want 2 of each", si.Len(), coll.Len())
+	}
+	if coll.writeAheadLog.Size() <= logSize {
+		t.Fatal("the good group wasn't logged")
+	}
+}
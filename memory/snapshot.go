@@ -0,0 +1,63 @@
+package memory
+
+// A snapshot is a point-in-time view of a collection: every record
+// created at or before Version and not deleted by then. Every record
+// carries the versions that created and deleted it, so a scan over a
+// snapshot keeps seeing the same set of documents however much the
+// collection changes underneath it. Nothing past End can be in the
+// snapshot, which saves scanning what's been appended since.
+type Snapshot struct {
+	Version uint64
+	End     Location
+}
+
+func (s Snapshot) visible(doc *Document) bool {
+	return doc.createdVersion <= s.Version && (!doc.deleted || doc.deletedVersion > s.Version)
+}
+
+func (coll *Collection) Snapshot() Snapshot {
+	return Snapshot{
+		Version: coll.currentDataFile.version,
+		End:     Location{File: coll.currentDataFile.number, Offset: coll.currentDataFile.offset},
+	}
+}
+
+// Take a snapshot that compaction will respect until it's unpinned,
+// keeping any record deleted after it was taken. Callers must hold
+// the write lock, for reading at least.
+func (coll *Collection) PinSnapshot() Snapshot {
+	snapshot := coll.Snapshot()
+	coll.pinLock.Lock()
+	defer coll.pinLock.Unlock()
+	if coll.pinnedVersions == nil {
+		coll.pinnedVersions = make(map[uint64]int)
+	}
+	coll.pinnedVersions[snapshot.Version]++
+	return snapshot
+}
+
+func (coll *Collection) UnpinSnapshot(snapshot Snapshot) {
+	coll.pinLock.Lock()
+	defer coll.pinLock.Unlock()
+	coll.pinnedVersions[snapshot.Version]--
+	if coll.pinnedVersions[snapshot.Version] <= 0 {
+		delete(coll.pinnedVersions, snapshot.Version)
+	}
+}
+
+// Deletes stamped after this version still matter to someone
+func (coll *Collection) oldestPinnedVersion() uint64 {
+	oldest := coll.currentDataFile.version
+	coll.pinLock.Lock()
+	defer coll.pinLock.Unlock()
+	for version := range coll.pinnedVersions {
+		if version < oldest {
+			oldest = version
+		}
+	}
+	return oldest
+}
+
+func (s Snapshot) Relocate(result *CompactionResult) Snapshot {
+	return Snapshot{Version: s.Version, End: result.Relocate(s.End)}
+}
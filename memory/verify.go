@@ -0,0 +1,122 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/gamechanger/gcdb/filesystem"
+)
+
+type VerifyReport struct {
+	FilesChecked   int
+	RecordsChecked int
+	DeletedRecords int
+	Corrupt        []*CorruptRecordError
+}
+
+func (r *VerifyReport) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Files checked: %d\nRecords checked: %d\nDeleted records: %d\nCorrupt records: %d",
+		r.FilesChecked, r.RecordsChecked, r.DeletedRecords, len(r.Corrupt)))
+	for _, corrupt := range r.Corrupt {
+		buf.WriteString("\n")
+		buf.WriteString(corrupt.Error())
+	}
+	return buf.String()
+}
+
+// Check every record in the collection's data files. Callers
+// must hold the write lock so nothing gets appended mid-check.
+func (coll *Collection) Verify() (*VerifyReport, error) {
+	err := coll.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	for _, mdf := range coll.dataFiles {
+		mdf.verify(report)
+	}
+	return report, nil
+}
+
+// Check the data files of the collection stored in dir without a
+// running server, mapping them read only so nothing gets written
+func VerifyOffline(dir string) (*VerifyReport, error) {
+	nums, err := filesystem.DataFileNumbers(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	for _, num := range nums {
+		mdf, err := openMappedDataFileReadOnly(dir, num)
+		if err != nil {
+			return nil, err
+		}
+		mdf.verify(report)
+		mdf.Close()
+	}
+	return report, nil
+}
+
+// Callers have to read the header themselves
+func openMappedDataFileReadOnly(dir string, fileNum int) (*MappedDataFile, error) {
+	file, err := filesystem.OpenDataFileReadOnly(dir, fileNum)
+	if err != nil {
+		return nil, err
+	}
+	mappedFile, err := mmap.Map(file, mmap.RDONLY, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &MappedDataFile{number: uint32(fileNum), file: file, mappedFile: &mappedFile}, nil
+}
+
+func (mdf *MappedDataFile) verify(report *VerifyReport) {
+	report.FilesChecked++
+	fileSize := uint64(len(*mdf.mappedFile))
+	if fileSize < uint64(DataStartOffset) || (*mdf.ReadBytesAtOffset(1, 0))[0] == 0 {
+		report.Corrupt = append(report.Corrupt, &CorruptRecordError{
+			Location: Location{File: mdf.number},
+			Reason:   "data file was never initialized"})
+		return
+	}
+	if mdf.readHeader() != nil {
+		report.Corrupt = append(report.Corrupt, &CorruptRecordError{
+			Location: Location{File: mdf.number},
+			Reason:   fmt.Sprintf("data file has unknown format %d", mdf.format)})
+		return
+	}
+	if mdf.offset < DataStartOffset || uint64(mdf.offset) > fileSize {
+		report.Corrupt = append(report.Corrupt, &CorruptRecordError{
+			Location: Location{File: mdf.number},
+			Reason:   fmt.Sprintf("header claims the data ends at offset %d", mdf.offset)})
+		return
+	}
+
+	idUnmarshalStruct := IdUnmarshaller{}
+	currentOffset := DataStartOffset
+	for currentOffset < mdf.offset {
+		report.RecordsChecked++
+		document, nextOffset, err := mdf.ReadDocumentAtOffset(currentOffset)
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, err.(*CorruptRecordError))
+			if nextOffset == 0 {
+				return
+			}
+			currentOffset = nextOffset
+			continue
+		}
+		if document.deleted {
+			report.DeletedRecords++
+		} else if err := json.Unmarshal(*document.Document, &idUnmarshalStruct); err != nil {
+			report.Corrupt = append(report.Corrupt, &CorruptRecordError{
+				Location:   document.Location,
+				Reason:     fmt.Sprintf("checksum is fine but the document isn't valid: %v", err),
+				NextOffset: nextOffset})
+		}
+		currentOffset = nextOffset
+	}
+}
@@ -0,0 +1,161 @@
+package memory
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gamechanger/gcdb/filesystem"
+)
+
+type legacyRecord struct {
+	data           []byte
+	deletedVersion uint64 // zero if it's live
+}
+
+// Write a data file the way releases before the current format did
+func writeLegacyDataFile(t *testing.T, dir string, fileNum int, format byte, version uint64, records []legacyRecord) {
+	t.Helper()
+	layout := recordLayouts[format]
+	contents := make([]byte, testDataFileSize)
+	offset := DataStartOffset
+	for _, record := range records {
+		header := make([]byte, layout.headerSize)
+		if record.deletedVersion != 0 {
+			header[0] = 1
+			binary.BigEndian.PutUint64(header[1:], record.deletedVersion)
+		}
+		binary.BigEndian.PutUint32(header[layout.lengthAt:], uint32(len(record.data)))
+		if layout.checksumAt != 0 {
+			crc := crc32.ChecksumIEEE(header[1+8 : layout.checksumAt])
+			binary.BigEndian.PutUint32(header[layout.checksumAt:], crc32.Update(crc, crc32.IEEETable, record.data))
+		}
+		offset += uint32(copy(contents[offset:], header))
+		offset += uint32(copy(contents[offset:], record.data))
+	}
+	contents[0] = format
+	binary.BigEndian.PutUint32(contents[1:], offset)
+	binary.BigEndian.PutUint64(contents[5:], version)
+	err := ioutil.WriteFile(filesystem.DataFilePath(dir, fileNum), contents, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func legacyRecords(ids []int, deleted ...int) []legacyRecord {
+	records := make([]legacyRecord, 0, len(ids)+len(deleted))
+	for _, id := range deleted {
+		records = append(records, legacyRecord{data: testDoc(id), deletedVersion: uint64(id + 1)})
+	}
+	for _, id := range ids {
+		records = append(records, legacyRecord{data: testDoc(id)})
+	}
+	return records
+}
+
+func verifyTestDir(t *testing.T, dir string) *VerifyReport {
+	t.Helper()
+	report, err := VerifyOffline(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestEveryFormatIsReadable(t *testing.T) {
+	for _, format := range []byte{formatOriginal, formatChecksummed} {
+		dir := t.TempDir()
+		writeLegacyDataFile(t, dir, 0, format, 10, legacyRecords(idRange(0, 5), 7, 8))
+		report := verifyTestDir(t, dir)
+		if report.RecordsChecked != 7 || report.DeletedRecords != 2 || len(report.Corrupt) != 0 {
+			t.Fatalf("format %d: %v", format, report)
+		}
+	}
+
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	insertTestDocs(t, coll, idRange(0, 5)...)
+	deleteTestDocs(t, coll, 2)
+	closeTestCollection(t, coll)
+	report := verifyTestDir(t, dir)
+	if report.RecordsChecked != 5 || report.DeletedRecords != 1 || len(report.Corrupt) != 0 {
+		t.Fatalf("format %d: %v", formatVersioned, report)
+	}
+}
+
+func TestVerifyFindsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	insertTestDocs(t, coll, idRange(0, 5)...)
+	closeTestCollection(t, coll)
+
+	// Flip a byte in the middle of the third document
+	path := filesystem.DataFilePath(dir, 0)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSize := int(RecordHeaderSize) + len(testDoc(0))
+	data[int(DataStartOffset)+2*recordSize+int(RecordHeaderSize)+2] ^= 0xFF
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := verifyTestDir(t, dir)
+	if report.RecordsChecked != 5 || len(report.Corrupt) != 1 || !strings.Contains(report.Corrupt[0].Reason, "checksum") {
+		t.Fatalf("%v", report)
+	}
+	// The length is intact, so the scan carries on past the bad record
+	coll = openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	expectIds(t, scanTestIds(t, coll), []int{0, 1, 3, 4})
+}
+
+func TestUnknownFormatIsRefused(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacyDataFile(t, dir, 0, formatChecksummed, 10, legacyRecords(idRange(0, 5)))
+	path := filesystem.DataFilePath(dir, 0)
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte{9}, 0)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := verifyTestDir(t, dir)
+	if len(report.Corrupt) != 1 || !strings.Contains(report.Corrupt[0].Reason, "unknown format 9") {
+		t.Fatalf("%v", report)
+	}
+	coll, err := openCollection("test", dir)
+	if err == nil {
+		closeTestCollection(t, coll)
+		t.Fatal("opened a collection with a data file in an unknown format")
+	}
+}
+
+func TestIndexBuildReportsInvalidDocuments(t *testing.T) {
+	dir := t.TempDir()
+	records := legacyRecords(idRange(0, 5))
+	// The checksum is computed over this, so only the JSON gives it away
+	records[3].data = []byte(`{"_id":3,"n":`)
+	writeLegacyDataFile(t, dir, 0, formatVersioned, 10, records)
+	recordSize := uint32(recordLayouts[formatVersioned].headerSize) + uint32(len(testDoc(0)))
+	bad := Location{File: 0, Offset: DataStartOffset + 3*recordSize}
+
+	_, err := openCollection("test", dir)
+	corrupt, ok := err.(*CorruptRecordError)
+	if !ok || corrupt.Location != bad {
+		t.Fatalf("opening returned %v, want a corrupt record at %v", err, bad)
+	}
+	report := verifyTestDir(t, dir)
+	if len(report.Corrupt) != 1 || report.Corrupt[0].Location != bad {
+		t.Fatalf("%v", report)
+	}
+}
@@ -0,0 +1,195 @@
+package memory
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/logging"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+// Every change to the mapped data files is described by a walRecord
+// and appended to the write-ahead log before we touch the mmap. The
+// record holds the raw bytes being written, so replaying it after a
+// crash is just writing them again, and doing that twice is harmless.
+
+// And the format for a record payload is:
+// First four bytes: uint32 number of writes
+// Then for each write:
+// Four bytes: uint32 data file number
+// Four bytes: uint32 offset within that file
+// Four bytes: uint32 length of the bytes written
+// Following bytes: the bytes written
+
+type walWrite struct {
+	file   uint32
+	offset uint32
+	data   []byte
+}
+
+type walRecord struct {
+	writes []walWrite
+}
+
+// How often every collection's log gets synced to disk
+var walSyncPolicy = wal.SyncInterval
+var walSyncInterval = constants.WALSyncIntervalMillis * time.Millisecond
+
+// Must be called before any collections are opened
+func SetWALSyncPolicy(policy wal.SyncPolicy, syncInterval time.Duration) {
+	walSyncPolicy = policy
+	walSyncInterval = syncInterval
+}
+
+// Open the log, replay whatever made it in there before we last went
+// down and checkpoint so we start with an empty log. Must be called
+// after the data files are open and before the indices are built.
+func (coll *Collection) openWriteAheadLog() error {
+	l, err := wal.Open(filesystem.WALPath(coll.dir), walSyncPolicy, walSyncInterval)
+	if err != nil {
+		return err
+	}
+	numRecords, err := l.Replay(func(payload []byte) error {
+		record, err := decodeWalRecord(payload)
+		if err != nil {
+			return err
+		}
+		return coll.apply(record)
+	})
+	if err != nil {
+		l.Close()
+		return err
+	}
+	if numRecords > 0 {
+		logging.Infof("Replayed %d records from the write-ahead log for %s", numRecords, coll.Name)
+	}
+	for _, mdf := range coll.dataFiles {
+		err = mdf.readHeader()
+		if err != nil {
+			l.Close()
+			return err
+		}
+	}
+	coll.writeAheadLog = l
+	return coll.checkpoint()
+}
+
+func (r *walRecord) add(mdf *MappedDataFile, offset uint32, data []byte) {
+	r.writes = append(r.writes, walWrite{file: mdf.number, offset: offset, data: data})
+}
+
+// Log the record, then apply it to the data files
+func (coll *Collection) commit(r *walRecord) error {
+	if coll.writeAheadLog != nil {
+		err := coll.writeAheadLog.Append(r.encode())
+		if err != nil {
+			return err
+		}
+	}
+	return coll.apply(r)
+}
+
+func (coll *Collection) apply(r *walRecord) error {
+	for _, write := range r.writes {
+		// A file we rolled over to since the last checkpoint
+		// might not have made it to disk before we went down
+		if int(write.file) == len(coll.dataFiles) {
+			mdf, err := coll.openMappedDataFile(len(coll.dataFiles))
+			if err != nil {
+				return err
+			}
+			coll.dataFiles = append(coll.dataFiles, mdf)
+			coll.currentDataFile = mdf
+		}
+		mdf, err := coll.dataFileForLocation(Location{File: write.file, Offset: write.offset})
+		if err != nil {
+			return err
+		}
+		if uint64(write.offset)+uint64(len(write.data)) > uint64(len(*mdf.mappedFile)) {
+			return errors.New(fmt.Sprintf("Write of %d bytes at offset %d runs off the end of %s/data.%d", len(write.data), write.offset, coll.Name, write.file))
+		}
+		mdf.WriteBytesAtOffset(write.data, write.offset)
+	}
+	return nil
+}
+
+func (r *walRecord) encode() []byte {
+	size := 4
+	for _, write := range r.writes {
+		size += 4 + 4 + 4 + len(write.data)
+	}
+	payload := make([]byte, size)
+	binary.BigEndian.PutUint32(payload, uint32(len(r.writes)))
+	pos := 4
+	for _, write := range r.writes {
+		binary.BigEndian.PutUint32(payload[pos:], write.file)
+		binary.BigEndian.PutUint32(payload[pos+4:], write.offset)
+		binary.BigEndian.PutUint32(payload[pos+8:], uint32(len(write.data)))
+		pos += 12
+		pos += copy(payload[pos:], write.data)
+	}
+	return payload
+}
+
+func decodeWalRecord(payload []byte) (*walRecord, error) {
+	malformed := errors.New("Malformed write-ahead log record")
+	if len(payload) < 4 {
+		return nil, malformed
+	}
+	numWrites := binary.BigEndian.Uint32(payload)
+	pos := uint64(4)
+	record := &walRecord{}
+	for idx := uint32(0); idx < numWrites; idx++ {
+		if pos+12 > uint64(len(payload)) {
+			return nil, malformed
+		}
+		write := walWrite{
+			file:   binary.BigEndian.Uint32(payload[pos:]),
+			offset: binary.BigEndian.Uint32(payload[pos+4:]),
+		}
+		length := uint64(binary.BigEndian.Uint32(payload[pos+8:]))
+		pos += 12
+		if pos+length > uint64(len(payload)) {
+			return nil, malformed
+		}
+		write.data = payload[pos : pos+length]
+		pos += length
+		record.writes = append(record.writes, write)
+	}
+	return record, nil
+}
+
+// Flush every data file, save the indexes and empty the log. Callers
+// must hold the write lock so nothing is appended underneath us.
+func (coll *Collection) checkpoint() error {
+	for _, mdf := range coll.dataFiles {
+		err := mdf.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if coll.idIndex != nil {
+		err := coll.saveIndexCheckpoints()
+		if err != nil {
+			return err
+		}
+	}
+	if coll.writeAheadLog == nil {
+		return nil
+	}
+	return coll.writeAheadLog.Truncate()
+}
+
+func (coll *Collection) maybeCheckpoint() {
+	if coll.writeAheadLog == nil || coll.writeAheadLog.Size() < constants.WALCheckpointBytes {
+		return
+	}
+	err := coll.checkpoint()
+	if err != nil {
+		logging.Errorf("Error checkpointing write-ahead log for %s: %v", coll.Name, err)
+	}
+}
@@ -0,0 +1,76 @@
+package memory
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/locks"
+)
+
+func flushTestCollection(t *testing.T, coll *Collection) {
+	t.Helper()
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	err := coll.FlushCurrentFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Put the log as it stands in coll's directory next to the data files
+// in crashDir, as if we'd gone down before they were flushed
+func crashWithLog(t *testing.T, coll *Collection, crashDir string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filesystem.WALPath(coll.dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		t.Fatal("nothing in the write-ahead log")
+	}
+	err = ioutil.WriteFile(filesystem.WALPath(crashDir), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritesSinceCheckpointAreReplayed(t *testing.T) {
+	dir := t.TempDir()
+	coll := openTestCollection(t, dir)
+	defer closeTestCollection(t, coll)
+	insertTestDocs(t, coll, idRange(0, 10)...)
+	flushTestCollection(t, coll)
+
+	// The data files as of the checkpoint
+	crashDir := t.TempDir()
+	copyDir(t, dir, crashDir)
+
+	insertTestDocs(t, coll, idRange(10, 100)...)
+	deleteTestDocs(t, coll, 3, 50)
+	crashWithLog(t, coll, crashDir)
+	// Plus half a record that never made it
+	appendToFile(t, filesystem.WALPath(crashDir), []byte{0, 0, 0, 40, 1, 2})
+
+	recovered := openTestCollection(t, crashDir)
+	defer closeTestCollection(t, recovered)
+	expectIds(t, scanTestIds(t, recovered), scanTestIds(t, coll))
+	if findTestDoc(t, recovered, 99) == nil || findTestDoc(t, recovered, 50) != nil {
+		t.Fatal("_id index doesn't match the replayed writes")
+	}
+	if recovered.writeAheadLog.Size() != 0 {
+		t.Fatalf("log still holds %d bytes after startup", recovered.writeAheadLog.Size())
+	}
+}
+
+func appendToFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	existing, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, append(existing, data...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,243 @@
+package memory
+
+import (
+	"fmt"
+
+	"github.com/gamechanger/gcdb/dberror"
+)
+
+// Every change to a collection goes through ApplyWrites as a group of
+// writes, and goes into the data files as part of a single write-ahead
+// log record: after a crash either the whole group happened or none
+// of it did. Each group gets the next op version, and every record it
+// creates or deletes is stamped with it, so a snapshot sees all of a
+// group or none. Groups that arrive together share a record, see
+// groupcommit.go.
+
+type WriteKind int
+
+const (
+	InsertWrite WriteKind = iota
+	UpdateWrite
+	DeleteWrite
+)
+
+type Write struct {
+	Kind WriteKind
+	Id   int
+	// The new document, nil for deletes
+	Data []byte
+}
+
+// Where a document stands partway through planning a group
+type plannedDoc struct {
+	location Location
+	data     []byte
+}
+
+// Writes planned into a single write-ahead log record. A batch can
+// hold any number of groups, each with an op version of its own, and
+// the file headers only get written once at the end.
+type writeBatch struct {
+	coll    *Collection
+	record  *walRecord
+	version uint64
+	groups  int
+	// Where each file we append to will end up, in the order we got to them
+	offsets map[*MappedDataFile]uint32
+	touched []*MappedDataFile
+	planned map[int]*plannedDoc
+	// Index changes to make once the record is safely logged,
+	// which can't fail since the record can't be taken back
+	effects []func()
+}
+
+// Callers must hold the write lock until the batch is committed
+func (coll *Collection) newWriteBatch() *writeBatch {
+	return &writeBatch{
+		coll:    coll,
+		record:  &walRecord{},
+		version: coll.currentDataFile.version,
+		offsets: make(map[*MappedDataFile]uint32),
+		planned: make(map[int]*plannedDoc),
+	}
+}
+
+// Plan a group of writes, in order, giving it the next op version.
+// If any of them can't go ahead the batch is left as it was.
+func (b *writeBatch) add(writes []Write) error {
+	err := b.checkWrites(writes)
+	if err != nil {
+		return err
+	}
+
+	// Planning can still fail reading an old document, so
+	// remember where we were to be able to back out
+	numRecordWrites, numTouched, numEffects := len(b.record.writes), len(b.touched), len(b.effects)
+	offsets := make(map[*MappedDataFile]uint32, len(b.offsets))
+	for mdf, offset := range b.offsets {
+		offsets[mdf] = offset
+	}
+	planned := make(map[int]*plannedDoc)
+	err = b.plan(writes, b.version+1, planned)
+	if err != nil {
+		b.record.writes = b.record.writes[:numRecordWrites]
+		b.touched = b.touched[:numTouched]
+		b.effects = b.effects[:numEffects]
+		b.offsets = offsets
+		return err
+	}
+
+	for id, doc := range planned {
+		b.planned[id] = doc
+	}
+	b.version++
+	b.groups++
+	return nil
+}
+
+func (b *writeBatch) plan(writes []Write, version uint64, planned map[int]*plannedDoc) error {
+	coll := b.coll
+	for _, write := range writes {
+		id := write.Id
+		if write.Kind != InsertWrite {
+			old, err := b.plannedDocFor(planned, id)
+			if err != nil {
+				return err
+			}
+			mdf, err := coll.dataFileForLocation(old.location)
+			if err != nil {
+				return err
+			}
+			oldDoc, err := coll.decodeForSecondaryIndexes(old.data)
+			if err != nil {
+				return err
+			}
+			b.record.add(mdf, old.location.Offset, append([]byte{1}, versionHeaderBytes(version)...))
+			planned[id] = nil
+			size := uint64(RecordHeaderSize) + uint64(len(old.data))
+			b.effects = append(b.effects, func() {
+				coll.liveBytes -= size
+				coll.DeleteFromIndex(id)
+				coll.removeFromSecondaryIndexes(id, oldDoc)
+			})
+		}
+		if write.Kind == DeleteWrite {
+			continue
+		}
+
+		doc, err := coll.decodeForSecondaryIndexes(write.Data)
+		if err != nil {
+			return dberror.Wrap(dberror.BadRequest, err)
+		}
+		recordSize := uint64(RecordHeaderSize) + uint64(len(write.Data))
+		mdf := coll.currentDataFile
+		offset, ok := b.offsets[mdf]
+		if !ok {
+			offset = mdf.offset
+		}
+		if uint64(offset)+recordSize > uint64(len(*mdf.mappedFile)) {
+			err := coll.rollOverCurrentDataFile()
+			if err != nil {
+				return err
+			}
+			mdf = coll.currentDataFile
+			offset = mdf.offset
+		}
+		if _, ok := b.offsets[mdf]; !ok {
+			b.touched = append(b.touched, mdf)
+		}
+		location := Location{File: mdf.number, Offset: offset}
+		b.record.add(mdf, offset, encodeRecord(write.Data, version))
+		b.offsets[mdf] = offset + uint32(recordSize)
+		planned[id] = &plannedDoc{location: location, data: write.Data}
+		b.effects = append(b.effects, func() {
+			coll.liveBytes += recordSize
+			coll.UpdateIndex(id, location)
+			coll.insertIntoSecondaryIndexes(id, doc, location)
+		})
+	}
+	return nil
+}
+
+// Log every group planned so far as one record, then apply it
+func (b *writeBatch) commit() error {
+	if b.groups == 0 {
+		return nil
+	}
+	coll := b.coll
+	for _, mdf := range b.touched {
+		b.record.add(mdf, 1, offsetHeaderBytes(b.offsets[mdf]))
+	}
+	b.record.add(coll.currentDataFile, 5, versionHeaderBytes(b.version))
+	err := coll.commit(b.record)
+	if err != nil {
+		return err
+	}
+
+	for _, mdf := range b.touched {
+		mdf.offset = b.offsets[mdf]
+	}
+	coll.currentDataFile.version = b.version
+	for _, effect := range b.effects {
+		effect()
+	}
+	coll.maybeCheckpoint()
+	return nil
+}
+
+// Make sure every write in the group can go ahead before we plan any
+// of them: inserts need a free _id, updates and deletes an existing one
+func (b *writeBatch) checkWrites(writes []Write) error {
+	coll := b.coll
+	exists := make(map[int]bool)
+	for _, write := range writes {
+		live, ok := exists[write.Id]
+		if !ok {
+			live = b.exists(write.Id)
+		}
+		switch write.Kind {
+		case InsertWrite:
+			if live {
+				return dberror.New(dberror.DuplicateKey, fmt.Sprintf("Id %d violates unique constraint, another document already has this Id", write.Id))
+			}
+		default:
+			if !live {
+				return dberror.New(dberror.NotFound, fmt.Sprintf("Id %d not found", write.Id))
+			}
+		}
+		if write.Kind != DeleteWrite {
+			recordSize := uint64(RecordHeaderSize) + uint64(len(write.Data))
+			if recordSize > uint64(len(*coll.currentDataFile.mappedFile))-uint64(DataStartOffset) {
+				return dberror.New(dberror.BadRequest, fmt.Sprintf("Document of %d bytes is too large to fit in a data file", len(write.Data)))
+			}
+		}
+		exists[write.Id] = write.Kind != DeleteWrite
+	}
+	return nil
+}
+
+// Whether the _id is taken once the groups planned so far are applied
+func (b *writeBatch) exists(id int) bool {
+	if doc, ok := b.planned[id]; ok {
+		return doc != nil
+	}
+	return b.coll.IdExistsInIndex(id)
+}
+
+// The document as it stands after the writes planned so far,
+// looking at the group being planned before the rest of the batch
+func (b *writeBatch) plannedDocFor(planned map[int]*plannedDoc, id int) (*plannedDoc, error) {
+	if doc, ok := planned[id]; ok {
+		return doc, nil
+	}
+	if doc, ok := b.planned[id]; ok {
+		return doc, nil
+	}
+	location, _ := b.coll.LookupLocationForIdInIndex(id)
+	doc, err := b.coll.ReadDocumentAtLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	return &plannedDoc{location: location, data: *doc.Document}, nil
+}
@@ -0,0 +1,216 @@
+package planner
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gamechanger/gcdb/dberror"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/query"
+)
+
+// The planner decides how to find the documents a query might match:
+// straight from the _id index, from a range of a secondary index,
+// or by scanning every document. Whatever it picks, each candidate
+// still gets checked against the full filter.
+
+const (
+	IdLookup       = "IDLOOKUP"
+	IndexScan      = "INDEXSCAN"
+	CollectionScan = "COLLSCAN"
+)
+
+// Only for debugging, the index command sets this to make every
+// query scan the collection and see what an index is buying you
+var ForceCollectionScans = false
+
+type Plan struct {
+	Kind   string
+	Index  string
+	coll   *memory.Collection
+	ids    []int
+	bounds *query.Bounds
+}
+
+type Stats struct {
+	KeysExamined int
+	DocsExamined int
+	DocsReturned int
+}
+
+func Choose(coll *memory.Collection, q *query.Query) *Plan {
+	if ForceCollectionScans {
+		return &Plan{Kind: CollectionScan, coll: coll}
+	}
+	if q.IdValues != nil {
+		return &Plan{Kind: IdLookup, Index: "_id", coll: coll, ids: q.IdValues}
+	}
+
+	// Exact values beat ranges, fewer values beat more,
+	// and a range closed at both ends beats an open one
+	var best *Plan
+	for _, path := range coll.IndexedPaths() {
+		bounds := q.Bounds(path)
+		if bounds == nil {
+			continue
+		}
+		if best == nil || better(bounds, best.bounds) {
+			best = &Plan{Kind: IndexScan, Index: path, coll: coll, bounds: bounds}
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return &Plan{Kind: CollectionScan, coll: coll}
+}
+
+func better(a, b *query.Bounds) bool {
+	if !a.IsRange() && !b.IsRange() {
+		return len(a.Values) < len(b.Values)
+	}
+	if a.IsRange() != b.IsRange() {
+		return !a.IsRange()
+	}
+	return closedEnds(a) > closedEnds(b)
+}
+
+func closedEnds(b *query.Bounds) int {
+	ends := 0
+	if b.HasLower {
+		ends++
+	}
+	if b.HasUpper {
+		ends++
+	}
+	return ends
+}
+
+func (p *Plan) String() string {
+	switch p.Kind {
+	case IdLookup:
+		return fmt.Sprintf("%s of %d ids", p.Kind, len(p.ids))
+	case IndexScan:
+		if p.bounds.IsRange() {
+			return fmt.Sprintf("%s on %s for range [%s, %s]", p.Kind, p.Index,
+				boundString(p.bounds.Lower, p.bounds.HasLower), boundString(p.bounds.Upper, p.bounds.HasUpper))
+		}
+		return fmt.Sprintf("%s on %s for %d values", p.Kind, p.Index, len(p.bounds.Values))
+	}
+	return p.Kind
+}
+
+func boundString(value interface{}, has bool) string {
+	if !has {
+		return "open"
+	}
+	if value == nil {
+		return "null"
+	}
+	return fmt.Sprint(value)
+}
+
+// Hand every document that might match to fn in turn,
+// stopping early if it returns false
+func (p *Plan) Candidates(stats *Stats, fn func(doc *memory.Document) (bool, error)) error {
+	switch p.Kind {
+	case IdLookup:
+		return p.idCandidates(stats, fn)
+	case IndexScan:
+		return p.indexCandidates(stats, fn)
+	}
+	return p.collectionCandidates(stats, fn)
+}
+
+func (p *Plan) idCandidates(stats *Stats, fn func(doc *memory.Document) (bool, error)) error {
+	ids := make([]int, len(p.ids))
+	copy(ids, p.ids)
+	sort.Ints(ids)
+	for idx, id := range ids {
+		if idx > 0 && ids[idx-1] == id {
+			continue
+		}
+		stats.KeysExamined++
+		doc, err := p.coll.IndexScanForId(id)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			continue
+		}
+		stats.DocsExamined++
+		more, err := fn(doc)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plan) indexCandidates(stats *Stats, fn func(doc *memory.Document) (bool, error)) error {
+	si := p.coll.GetSecondaryIndex(p.Index)
+	if si == nil {
+		return dberror.New(dberror.NotFound, fmt.Sprintf("Index on %s was dropped", p.Index))
+	}
+
+	// Arrays put the same document in the index more than once
+	seen := make(map[int]bool)
+	locations := make([]memory.Location, 0)
+	collect := func(entry memory.SecondaryIndexEntry) bool {
+		stats.KeysExamined++
+		if !seen[entry.Id] {
+			seen[entry.Id] = true
+			locations = append(locations, entry.Location)
+		}
+		return true
+	}
+	if p.bounds.IsRange() {
+		si.AscendRange(p.bounds.Lower, p.bounds.HasLower, p.bounds.Upper, p.bounds.HasUpper, collect)
+	} else {
+		for _, value := range p.bounds.Values {
+			si.AscendRange(value, true, value, true, collect)
+		}
+	}
+
+	for _, location := range locations {
+		doc, err := p.coll.ReadDocumentAtLocation(location)
+		if err != nil {
+			return err
+		}
+		stats.DocsExamined++
+		more, err := fn(doc)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plan) collectionCandidates(stats *Stats, fn func(doc *memory.Document) (bool, error)) error {
+	location := memory.FirstLocation()
+	snapshot := p.coll.Snapshot()
+	for {
+		docs, err := p.coll.CollectionScanFromLocation(location, snapshot, 100)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			location = doc.Next
+			stats.DocsExamined++
+			more, err := fn(doc)
+			if err != nil || !more {
+				return err
+			}
+		}
+		if len(docs) < 100 {
+			return nil
+		}
+	}
+}
+
+// Look up a single document by _id
+func FindById(coll *memory.Collection, id int) (*memory.Document, error) {
+	if ForceCollectionScans {
+		return coll.CollectionScanForId(id)
+	}
+	return coll.IndexScanForId(id)
+}
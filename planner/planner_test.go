@@ -0,0 +1,171 @@
+package planner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/query"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+func TestMain(m *testing.M) {
+	filesystem.SetDataFileSize(1 << 16)
+	memory.SetWALSyncPolicy(wal.SyncNever, 0)
+	memory.StartWriter()
+	os.Exit(m.Run())
+}
+
+// A collection where every third document has a null n,
+// every third has no n at all and the rest have n equal to the _id
+func openTestCollection(t *testing.T) *memory.Collection {
+	t.Helper()
+	cat, err := memory.OpenCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cat.Close() })
+	coll, err := cat.EnsureCollection("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 0; id < 30; id++ {
+		data := fmt.Sprintf(`{"_id":%d,"n":%d}`, id, id)
+		switch id % 3 {
+		case 1:
+			data = fmt.Sprintf(`{"_id":%d,"n":null}`, id)
+		case 2:
+			data = fmt.Sprintf(`{"_id":%d}`, id)
+		}
+		err = coll.ApplyWrites([]memory.Write{{Kind: memory.InsertWrite, Id: id, Data: []byte(data)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	_, err = coll.CreateSecondaryIndex("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coll
+}
+
+func forceCollectionScans(t *testing.T) {
+	ForceCollectionScans = true
+	t.Cleanup(func() { ForceCollectionScans = false })
+}
+
+// Plan the query and return the sorted _ids of the matching documents
+func run(t *testing.T, coll *memory.Collection, body string) (*Plan, *Stats, []int) {
+	t.Helper()
+	q, err := query.Parse([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks.GlobalWriteLock.RLock()
+	defer locks.GlobalWriteLock.RUnlock()
+	plan := Choose(coll, q)
+	stats := &Stats{}
+	ids := make([]int, 0)
+	err = plan.Candidates(stats, func(doc *memory.Document) (bool, error) {
+		decoded := make(map[string]interface{})
+		err := json.Unmarshal(*doc.Document, &decoded)
+		if err != nil {
+			return false, err
+		}
+		if q.Matches(decoded) {
+			ids = append(ids, int(decoded["_id"].(float64)))
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ids)
+	return plan, stats, ids
+}
+
+func expectIds(t *testing.T, got []int, want ...int) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got ids %v, want %v", got, want)
+	}
+}
+
+func TestPlanFollowsTheQuery(t *testing.T) {
+	coll := openTestCollection(t)
+	for _, test := range []struct {
+		body string
+		kind string
+		docs int
+	}{
+		{`{"filter": {"_id": 3}}`, IdLookup, 1},
+		{`{"filter": {"n": 3}}`, IndexScan, 1},
+		{`{"filter": {"m": 3}}`, CollectionScan, 30},
+	} {
+		plan, stats, _ := run(t, coll, test.body)
+		if plan.Kind != test.kind || stats.DocsExamined != test.docs {
+			t.Fatalf("%s: %s examining %d documents", test.body, plan, stats.DocsExamined)
+		}
+	}
+}
+
+func TestForcedCollectionScans(t *testing.T) {
+	coll := openTestCollection(t)
+	forceCollectionScans(t)
+	for _, body := range []string{`{"filter": {"_id": 3}}`, `{"filter": {"n": 3}}`} {
+		plan, stats, ids := run(t, coll, body)
+		if plan.Kind != CollectionScan || stats.DocsExamined != 30 {
+			t.Fatalf("%s: %s examining %d documents", body, plan, stats.DocsExamined)
+		}
+		expectIds(t, ids, 3)
+	}
+}
+
+func TestNullOnlyExaminesNullKeys(t *testing.T) {
+	coll := openTestCollection(t)
+	plan, stats, ids := run(t, coll, `{"filter": {"n": null}}`)
+	if plan.Kind != IndexScan || plan.Index != "n" {
+		t.Fatalf("planned %s", plan)
+	}
+	// Missing fields are indexed as null too, but only match $exists
+	if stats.KeysExamined != 20 {
+		t.Fatalf("examined %d keys for 20 null entries", stats.KeysExamined)
+	}
+	expectIds(t, ids, 1, 4, 7, 10, 13, 16, 19, 22, 25, 28)
+}
+
+func TestIndexRanges(t *testing.T) {
+	coll := openTestCollection(t)
+
+	plan, stats, ids := run(t, coll, `{"filter": {"n": {"$gte": 6, "$lte": 12}}}`)
+	if plan.String() != "INDEXSCAN on n for range [6, 12]" || stats.KeysExamined != 3 {
+		t.Fatalf("%s examining %d keys", plan, stats.KeysExamined)
+	}
+	expectIds(t, ids, 6, 9, 12)
+
+	plan, stats, ids = run(t, coll, `{"filter": {"n": {"$gt": 20}}}`)
+	if plan.String() != "INDEXSCAN on n for range [20, open]" || stats.KeysExamined != 3 {
+		t.Fatalf("%s examining %d keys", plan, stats.KeysExamined)
+	}
+	expectIds(t, ids, 21, 24, 27)
+
+	// Null sorts first, so an upper bound of null is only the nulls
+	plan, stats, ids = run(t, coll, `{"filter": {"n": {"$lte": null}}}`)
+	if plan.String() != "INDEXSCAN on n for range [open, null]" || stats.KeysExamined != 20 {
+		t.Fatalf("%s examining %d keys", plan, stats.KeysExamined)
+	}
+
+	plan, _, ids = run(t, coll, `{"filter": {"n": {"$in": [3, 4, 5]}}}`)
+	if plan.Kind != IndexScan {
+		t.Fatalf("planned %s", plan)
+	}
+	expectIds(t, ids, 3)
+}
@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Clients that want the binary protocol send Magic followed by a
+// version byte as soon as they connect, and the server echoes both
+// back. Anything else gets the human-readable prompt. After that,
+// every request is a frame:
+// First four bytes: uint32 request id, echoed back in the reply
+// Next byte: opcode, which command to run
+// Next four bytes: uint32 length of the body
+// Following bytes: the body, the same text the command takes at the prompt
+// And every reply is a frame:
+// First four bytes: uint32 request id of the request it answers
+// Next byte: status, StatusOK or the dberror code of what went wrong
+// Next four bytes: uint32 length of the body
+// Following bytes: the response, or the error message
+// Requests may be pipelined, replies come back in the order sent.
+
+const (
+	Version         = byte(1)
+	FrameHeaderSize = 4 + 1 + 4
+	// Nothing we could store is bigger than a data file anyway
+	MaxBodySize = 256 * 1024 * 1024
+)
+
+// No one types a NUL into telnet
+var Magic = []byte{0, 'g', 'c', 'd', 'b'}
+
+type Opcode byte
+
+const (
+	OpHi Opcode = iota + 1
+	OpInsert
+	OpFindId
+	OpFindAll
+	OpFind
+	OpExplain
+	OpGetMore
+	OpDeleteId
+	OpUpdateId
+	OpIndex
+	OpFlush
+	OpStats
+	OpCompact
+	OpVerify
+	OpCreateIndex
+	OpDropIndex
+	OpCreateCollection
+	OpDropCollection
+	OpListCollections
+	OpUse
+	OpListDatabases
+	OpHelp
+	OpShutdown
+	OpKillCursor
+	OpCursors
+	OpBegin
+	OpCommit
+	OpAbort
+	OpInsertMany
+)
+
+// The prompt command each opcode stands for
+var opcodeCommands = map[Opcode]string{
+	OpHi:               "hi",
+	OpInsert:           "insert",
+	OpFindId:           "findid",
+	OpFindAll:          "findall",
+	OpFind:             "find",
+	OpExplain:          "explain",
+	OpGetMore:          "getmore",
+	OpDeleteId:         "deleteid",
+	OpUpdateId:         "updateid",
+	OpIndex:            "index",
+	OpFlush:            "flush",
+	OpStats:            "stats",
+	OpCompact:          "compact",
+	OpVerify:           "verify",
+	OpCreateIndex:      "createindex",
+	OpDropIndex:        "dropindex",
+	OpCreateCollection: "createcollection",
+	OpDropCollection:   "dropcollection",
+	OpListCollections:  "listcollections",
+	OpUse:              "use",
+	OpListDatabases:    "listdatabases",
+	OpHelp:             "help",
+	OpShutdown:         "shutdown",
+	OpKillCursor:       "killcursor",
+	OpCursors:          "cursors",
+	OpBegin:            "begin",
+	OpCommit:           "commit",
+	OpAbort:            "abort",
+	OpInsertMany:       "insertmany",
+}
+
+func (op Opcode) Command() (string, bool) {
+	command, ok := opcodeCommands[op]
+	return command, ok
+}
+
+// Anything other than StatusOK is a dberror.Code
+type Status byte
+
+const StatusOK = Status(0)
+
+type Request struct {
+	Id     uint32
+	Opcode Opcode
+	Body   []byte
+}
+
+type Reply struct {
+	Id     uint32
+	Status Status
+	Body   []byte
+}
+
+// Shared by both kinds of frame, the middle byte is either
+// the opcode or the status depending on which way it's going
+func readFrame(r io.Reader) (uint32, byte, []byte, error) {
+	header := make([]byte, FrameHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[5:])
+	if length > MaxBodySize {
+		return 0, 0, nil, errors.New(fmt.Sprintf("Frame body of %d bytes is over the limit of %d", length, MaxBodySize))
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header), header[4], body, nil
+}
+
+// The header and body go out in a single write so
+// frames from different goroutines can't interleave
+func writeFrame(w io.Writer, id uint32, kind byte, body []byte) error {
+	frame := make([]byte, FrameHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame, id)
+	frame[4] = kind
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(body)))
+	copy(frame[FrameHeaderSize:], body)
+	_, err := w.Write(frame)
+	return err
+}
+
+func ReadRequest(r io.Reader) (*Request, error) {
+	id, opcode, body, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Id: id, Opcode: Opcode(opcode), Body: body}, nil
+}
+
+func WriteRequest(w io.Writer, request *Request) error {
+	return writeFrame(w, request.Id, byte(request.Opcode), request.Body)
+}
+
+func ReadReply(r io.Reader) (*Reply, error) {
+	id, status, body, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reply{Id: id, Status: Status(status), Body: body}, nil
+}
+
+func WriteReply(w io.Writer, reply *Reply) error {
+	return writeFrame(w, reply.Id, byte(reply.Status), reply.Body)
+}
+
+// The client's half of the handshake
+func Negotiate(rw io.ReadWriter) error {
+	_, err := rw.Write(append(append([]byte{}, Magic...), Version))
+	if err != nil {
+		return err
+	}
+	response := make([]byte, len(Magic)+1)
+	_, err = io.ReadFull(rw, response)
+	if err != nil {
+		return err
+	}
+	for idx := range Magic {
+		if response[idx] != Magic[idx] {
+			return errors.New("Server did not accept the binary protocol")
+		}
+	}
+	if response[len(Magic)] != Version {
+		return errors.New(fmt.Sprintf("Server speaks protocol version %d, we speak %d", response[len(Magic)], Version))
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFramesRoundTrip(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	requests := []*Request{
+		{Id: 1, Opcode: OpInsert, Body: []byte(`test {"_id": 1}`)},
+		{Id: 2, Opcode: OpHi, Body: []byte{}},
+		{Id: 0xFFFFFFFF, Opcode: OpGetMore, Body: []byte("7")},
+	}
+	// Pipelined, one after another on the same stream
+	for _, request := range requests {
+		err := WriteRequest(buffer, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range requests {
+		got, err := ReadRequest(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != want.Id || got.Opcode != want.Opcode || !bytes.Equal(got.Body, want.Body) {
+			t.Fatalf("read %+v, want %+v", got, want)
+		}
+	}
+	if _, err := ReadRequest(buffer); err != io.EOF {
+		t.Fatalf("reading past the last frame returned %v", err)
+	}
+
+	reply := &Reply{Id: 3, Status: Status(4), Body: []byte("Could not find cursor")}
+	err := WriteReply(buffer, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.Len() != FrameHeaderSize+len(reply.Body) {
+		t.Fatalf("reply frame is %d bytes", buffer.Len())
+	}
+	got, err := ReadReply(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != reply.Id || got.Status != reply.Status || !bytes.Equal(got.Body, reply.Body) {
+		t.Fatalf("read %+v, want %+v", got, reply)
+	}
+}
+
+func encodeRequest(t *testing.T, request *Request) []byte {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	err := WriteRequest(buffer, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestShortFrames(t *testing.T) {
+	frame := encodeRequest(t, &Request{Id: 1, Opcode: OpFindId, Body: []byte("test 1")})
+	for _, length := range []int{1, FrameHeaderSize - 1, FrameHeaderSize, len(frame) - 1} {
+		_, err := ReadRequest(bytes.NewReader(frame[:length]))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("frame cut to %d bytes returned %v", length, err)
+		}
+	}
+}
+
+func TestOversizedFrames(t *testing.T) {
+	header := make([]byte, FrameHeaderSize)
+	binary.BigEndian.PutUint32(header[5:], MaxBodySize+1)
+	// Turned away on the header alone, before reading or allocating the body
+	_, err := ReadRequest(bytes.NewReader(header))
+	if err == nil || !strings.Contains(err.Error(), "over the limit") {
+		t.Fatalf("oversized frame returned %v", err)
+	}
+	_, err = ReadReply(bytes.NewReader(header))
+	if err == nil || !strings.Contains(err.Error(), "over the limit") {
+		t.Fatalf("oversized reply returned %v", err)
+	}
+}
+
+func TestOpcodes(t *testing.T) {
+	for op, command := range opcodeCommands {
+		got, ok := op.Command()
+		if !ok || got != command {
+			t.Fatalf("opcode %d is %q", op, got)
+		}
+	}
+	for _, op := range []Opcode{0, OpInsertMany + 1, 255} {
+		if _, ok := op.Command(); ok {
+			t.Fatalf("opcode %d stands for a command", op)
+		}
+	}
+}
+
+// Answer a client's handshake with whatever response is
+func negotiateWith(t *testing.T, response []byte) error {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		handshake := make([]byte, len(Magic)+1)
+		_, err := io.ReadFull(server, handshake)
+		if err != nil || !bytes.Equal(handshake, append(append([]byte{}, Magic...), Version)) {
+			return
+		}
+		server.Write(response)
+	}()
+	return Negotiate(client)
+}
+
+func TestNegotiate(t *testing.T) {
+	err := negotiateWith(t, append(append([]byte{}, Magic...), Version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = negotiateWith(t, append(append([]byte{}, Magic...), Version+1))
+	if err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("version mismatch returned %v", err)
+	}
+	err = negotiateWith(t, []byte("gcdb> "))
+	if err == nil || !strings.Contains(err.Error(), "did not accept") {
+		t.Fatalf("a prompt returned %v", err)
+	}
+	err = negotiateWith(t, []byte("gc"))
+	if err == nil {
+		t.Fatal("a short response was accepted")
+	}
+}
@@ -0,0 +1,491 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gamechanger/gcdb/values"
+)
+
+// A find query is a JSON document like
+// {"filter": {"user.team_id": 5, "age": {"$gt": 20}},
+//  "projection": {"name": 1},
+//  "sort": [{"age": -1}, {"name": 1}],
+//  "limit": 10}
+// where every key is optional. Filters support plain equality plus
+// $gt, $gte, $lt, $lte, $ne, $in and $exists on a field, and
+// $and and $or taking a list of filters.
+
+type SortField struct {
+	Path      string
+	Ascending bool
+}
+
+type Query struct {
+	filter     condition
+	Projection map[string]bool
+	Sort       []SortField
+	Limit      int
+	// How the cursor hands out results, these don't change what matches
+	BatchSize int
+	MaxBytes  int
+	// _id values the filter restricts us to, nil if it doesn't
+	IdValues []int
+}
+
+type rawQuery struct {
+	Filter     map[string]interface{} `json:"filter"`
+	Projection map[string]interface{} `json:"projection"`
+	Sort       interface{}            `json:"sort"`
+	Limit      int                    `json:"limit"`
+	BatchSize  int                    `json:"batchSize"`
+	MaxBytes   int                    `json:"maxBytes"`
+}
+
+func Parse(body []byte) (*Query, error) {
+	raw := rawQuery{}
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw.Limit < 0 {
+		return nil, errors.New("limit must not be negative")
+	}
+	if raw.BatchSize < 0 || raw.MaxBytes < 0 {
+		return nil, errors.New("batchSize and maxBytes must not be negative")
+	}
+
+	q := &Query{Limit: raw.Limit, BatchSize: raw.BatchSize, MaxBytes: raw.MaxBytes}
+	q.filter, err = parseFilter(raw.Filter)
+	if err != nil {
+		return nil, err
+	}
+	q.IdValues = idValues(q.filter)
+	q.Projection, err = parseProjection(raw.Projection)
+	if err != nil {
+		return nil, err
+	}
+	q.Sort, err = parseSort(raw.Sort)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Query) Matches(doc map[string]interface{}) bool {
+	return q.filter.matches(doc)
+}
+
+// Conditions on values in a document
+
+type condition interface {
+	matches(doc map[string]interface{}) bool
+}
+
+type andCondition []condition
+
+type orCondition []condition
+
+type fieldCondition struct {
+	path     string
+	operator string
+	value    interface{}
+}
+
+func (c andCondition) matches(doc map[string]interface{}) bool {
+	for _, sub := range c {
+		if !sub.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c orCondition) matches(doc map[string]interface{}) bool {
+	for _, sub := range c {
+		if sub.matches(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fieldCondition) matches(doc map[string]interface{}) bool {
+	value, exists := values.Lookup(doc, c.path)
+	switch c.operator {
+	case "$exists":
+		return exists == c.value.(bool)
+	case "$eq":
+		return exists && equalOrContains(value, c.value)
+	case "$ne":
+		return !exists || !equalOrContains(value, c.value)
+	case "$in":
+		if !exists {
+			return false
+		}
+		for _, candidate := range c.value.([]interface{}) {
+			if equalOrContains(value, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Ordering comparisons only ever match values of the same type
+	if !exists || !values.SameType(value, c.value) {
+		return false
+	}
+	cmp := values.Compare(value, c.value)
+	switch c.operator {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+// An array field matches if any of its elements does
+func equalOrContains(value, target interface{}) bool {
+	if values.Compare(value, target) == 0 {
+		return true
+	}
+	if array, ok := value.([]interface{}); ok {
+		for _, element := range array {
+			if values.Compare(element, target) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseFilter(filter map[string]interface{}) (condition, error) {
+	conditions := andCondition{}
+	for key, value := range filter {
+		switch key {
+		case "$and", "$or":
+			list, ok := value.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, errors.New(fmt.Sprintf("%s takes a non-empty list of filters", key))
+			}
+			subs := make([]condition, 0, len(list))
+			for _, item := range list {
+				subFilter, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("%s takes a non-empty list of filters", key))
+				}
+				sub, err := parseFilter(subFilter)
+				if err != nil {
+					return nil, err
+				}
+				subs = append(subs, sub)
+			}
+			if key == "$and" {
+				conditions = append(conditions, andCondition(subs))
+			} else {
+				conditions = append(conditions, orCondition(subs))
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, errors.New(fmt.Sprintf("Unknown top level operator %s", key))
+			}
+			fieldConditions, err := parseFieldFilter(key, value)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, fieldConditions...)
+		}
+	}
+	return conditions, nil
+}
+
+func parseFieldFilter(path string, value interface{}) ([]condition, error) {
+	operators, ok := value.(map[string]interface{})
+	if !ok || len(operators) == 0 || !isOperatorObject(operators) {
+		return []condition{&fieldCondition{path: path, operator: "$eq", value: value}}, nil
+	}
+	conditions := make([]condition, 0, len(operators))
+	for operator, operand := range operators {
+		switch operator {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		case "$in":
+			if _, ok := operand.([]interface{}); !ok {
+				return nil, errors.New(fmt.Sprintf("$in on %s takes a list", path))
+			}
+		case "$exists":
+			if _, ok := operand.(bool); !ok {
+				return nil, errors.New(fmt.Sprintf("$exists on %s takes true or false", path))
+			}
+		default:
+			return nil, errors.New(fmt.Sprintf("Unknown operator %s on %s", operator, path))
+		}
+		conditions = append(conditions, &fieldCondition{path: path, operator: operator, value: operand})
+	}
+	return conditions, nil
+}
+
+func isOperatorObject(object map[string]interface{}) bool {
+	for key := range object {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// If every match must have one of a known set of _ids, return them
+// so the caller can go straight to the _id index
+func idValues(c condition) []int {
+	and, ok := c.(andCondition)
+	if !ok {
+		return nil
+	}
+	for _, sub := range and {
+		if field, ok := sub.(*fieldCondition); ok && field.path == "_id" {
+			switch field.operator {
+			case "$eq":
+				return toIds([]interface{}{field.value})
+			case "$in":
+				return toIds(field.value.([]interface{}))
+			}
+		}
+		if ids := idValues(sub); ids != nil {
+			return ids
+		}
+	}
+	return nil
+}
+
+// Only integers can be _ids, anything else just can't match
+func toIds(list []interface{}) []int {
+	ids := make([]int, 0, len(list))
+	for _, item := range list {
+		if f, ok := item.(float64); ok && f == float64(int(f)) {
+			ids = append(ids, int(f))
+		}
+	}
+	return ids
+}
+
+// The values a field has to fall within for a document to match,
+// as far as the top level of the filter can tell us. Either a set of
+// exact values or an inclusive range. Null is a value like any other,
+// so HasLower and HasUpper say whether the range has each end.
+type Bounds struct {
+	Values   []interface{}
+	Lower    interface{}
+	Upper    interface{}
+	HasLower bool
+	HasUpper bool
+}
+
+func (b *Bounds) IsRange() bool {
+	return b.Values == nil
+}
+
+// Returns nil if the filter doesn't constrain the field in a way an
+// index can help with. Documents inside the bounds still need to be
+// checked with Matches, this only rules documents out.
+func (q *Query) Bounds(path string) *Bounds {
+	and, ok := q.filter.(andCondition)
+	if !ok {
+		return nil
+	}
+	var bounds *Bounds
+	for _, sub := range and {
+		field, ok := sub.(*fieldCondition)
+		if !ok || field.path != path {
+			continue
+		}
+		switch field.operator {
+		case "$eq":
+			return &Bounds{Values: []interface{}{field.value}}
+		case "$in":
+			return &Bounds{Values: field.value.([]interface{})}
+		case "$gt", "$gte":
+			if bounds == nil {
+				bounds = &Bounds{}
+			}
+			if !bounds.HasLower || values.Compare(field.value, bounds.Lower) > 0 {
+				bounds.Lower = field.value
+				bounds.HasLower = true
+			}
+		case "$lt", "$lte":
+			if bounds == nil {
+				bounds = &Bounds{}
+			}
+			if !bounds.HasUpper || values.Compare(field.value, bounds.Upper) < 0 {
+				bounds.Upper = field.value
+				bounds.HasUpper = true
+			}
+		}
+	}
+	return bounds
+}
+
+func parseProjection(projection map[string]interface{}) (map[string]bool, error) {
+	if len(projection) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]bool)
+	var including *bool
+	for path, value := range projection {
+		var include bool
+		switch v := value.(type) {
+		case float64:
+			include = v != 0
+		case bool:
+			include = v
+		default:
+			return nil, errors.New(fmt.Sprintf("Projection of %s must be 1 or 0", path))
+		}
+		parsed[path] = include
+		if path == "_id" {
+			continue
+		}
+		if including != nil && *including != include {
+			return nil, errors.New("Projection can't mix included and excluded fields")
+		}
+		including = &include
+	}
+	return parsed, nil
+}
+
+// Apply the projection, or return the document as is if there isn't one
+func (q *Query) Project(doc map[string]interface{}) map[string]interface{} {
+	if q.Projection == nil {
+		return doc
+	}
+	including := false
+	for path, include := range q.Projection {
+		if path != "_id" && include {
+			including = true
+		}
+	}
+
+	if !including {
+		projected := copyDocument(doc)
+		for path, include := range q.Projection {
+			if !include {
+				removePath(projected, path)
+			}
+		}
+		return projected
+	}
+
+	projected := make(map[string]interface{})
+	if include, ok := q.Projection["_id"]; !ok || include {
+		if id, ok := doc["_id"]; ok {
+			projected["_id"] = id
+		}
+	}
+	for path, include := range q.Projection {
+		if !include || path == "_id" {
+			continue
+		}
+		if value, ok := values.Lookup(doc, path); ok {
+			setPath(projected, path, value)
+		}
+	}
+	return projected
+}
+
+func copyDocument(doc map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		if object, ok := value.(map[string]interface{}); ok {
+			value = copyDocument(object)
+		}
+		copied[key] = value
+	}
+	return copied
+}
+
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	pieces := strings.Split(path, ".")
+	current := doc
+	for _, piece := range pieces[:len(pieces)-1] {
+		next, ok := current[piece].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[piece] = next
+		}
+		current = next
+	}
+	current[pieces[len(pieces)-1]] = value
+}
+
+func removePath(doc map[string]interface{}, path string) {
+	pieces := strings.Split(path, ".")
+	current := doc
+	for _, piece := range pieces[:len(pieces)-1] {
+		next, ok := current[piece].(map[string]interface{})
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, pieces[len(pieces)-1])
+}
+
+// Sort can be a list of single key objects, or just one object
+// if there's only one field to sort on
+func parseSort(raw interface{}) ([]SortField, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var specs []interface{}
+	switch v := raw.(type) {
+	case []interface{}:
+		specs = v
+	case map[string]interface{}:
+		if len(v) > 1 {
+			return nil, errors.New("Sorting on more than one field needs a list like [{\"a\": 1}, {\"b\": -1}]")
+		}
+		specs = []interface{}{v}
+	default:
+		return nil, errors.New("sort takes a list like [{\"a\": 1}, {\"b\": -1}]")
+	}
+
+	fields := make([]SortField, 0, len(specs))
+	for _, spec := range specs {
+		object, ok := spec.(map[string]interface{})
+		if !ok || len(object) != 1 {
+			return nil, errors.New("Each sort entry must be an object with a single field")
+		}
+		for path, direction := range object {
+			d, ok := direction.(float64)
+			if !ok || (d != 1 && d != -1) {
+				return nil, errors.New(fmt.Sprintf("Sort direction for %s must be 1 or -1", path))
+			}
+			fields = append(fields, SortField{Path: path, Ascending: d == 1})
+		}
+	}
+	return fields, nil
+}
+
+// Whether a sorts before b, missing fields sort as null
+func (q *Query) Less(a, b map[string]interface{}) bool {
+	for _, field := range q.Sort {
+		valueA, _ := values.Lookup(a, field.Path)
+		valueB, _ := values.Lookup(b, field.Path)
+		cmp := values.Compare(valueA, valueB)
+		if cmp == 0 {
+			continue
+		}
+		if field.Ascending {
+			return cmp < 0
+		}
+		return cmp > 0
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func parseTestQuery(t *testing.T, body string) *Query {
+	t.Helper()
+	q, err := Parse([]byte(body))
+	if err != nil {
+		t.Fatalf("%s: %v", body, err)
+	}
+	return q
+}
+
+func decodeTestDoc(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	doc := make(map[string]interface{})
+	err := json.Unmarshal([]byte(data), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func encodeTestDoc(t *testing.T, doc map[string]interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+var testDocs = []string{
+	`{"_id": 0, "n": 1, "name": "ann", "user": {"team_id": 5}, "tags": ["a", "b"]}`,
+	`{"_id": 1, "n": 2, "name": "bob", "user": {"team_id": 6}, "tags": ["b"]}`,
+	`{"_id": 2, "n": 3, "name": "cat", "user": {}, "tags": []}`,
+	`{"_id": 3, "n": null, "name": "dan"}`,
+	`{"_id": 4, "name": "eve", "user": {"team_id": "5"}}`,
+}
+
+// The _ids of the test documents the filter matches
+func matchingIds(t *testing.T, filter string) []int {
+	t.Helper()
+	q := parseTestQuery(t, fmt.Sprintf(`{"filter": %s}`, filter))
+	ids := make([]int, 0)
+	for _, data := range testDocs {
+		doc := decodeTestDoc(t, data)
+		if q.Matches(doc) {
+			ids = append(ids, int(doc["_id"].(float64)))
+		}
+	}
+	return ids
+}
+
+func TestFilters(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		want   []int
+	}{
+		{`{}`, []int{0, 1, 2, 3, 4}},
+		{`{"n": 2}`, []int{1}},
+		{`{"n": {"$eq": 2}}`, []int{1}},
+		{`{"n": {"$ne": 2}}`, []int{0, 2, 3, 4}},
+		{`{"n": {"$gt": 1}}`, []int{1, 2}},
+		{`{"n": {"$gte": 2}}`, []int{1, 2}},
+		{`{"n": {"$lt": 3}}`, []int{0, 1}},
+		{`{"n": {"$lte": 2}}`, []int{0, 1}},
+		{`{"n": {"$gt": 1, "$lt": 3}}`, []int{1}},
+		{`{"n": {"$in": [1, 3, 7]}}`, []int{0, 2}},
+		{`{"n": {"$exists": true}}`, []int{0, 1, 2, 3}},
+		{`{"n": {"$exists": false}}`, []int{4}},
+		{`{"name": {"$gte": "bob", "$lt": "dan"}}`, []int{1, 2}},
+		// Ordering comparisons don't cross types
+		{`{"name": {"$gt": 1}}`, []int{}},
+		{`{"$and": [{"n": {"$gte": 1}}, {"n": {"$lte": 2}}]}`, []int{0, 1}},
+		{`{"$or": [{"n": 1}, {"name": "eve"}]}`, []int{0, 4}},
+		{`{"$or": [{"n": 1}, {"$and": [{"name": "cat"}, {"n": 3}]}]}`, []int{0, 2}},
+		{`{"n": {"$gte": 1}, "$or": [{"name": "ann"}, {"name": "dan"}]}`, []int{0}},
+	} {
+		got := matchingIds(t, test.filter)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s matched %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestDottedPathsAndArrays(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		want   []int
+	}{
+		{`{"user.team_id": 5}`, []int{0}},
+		{`{"user.team_id": "5"}`, []int{4}},
+		{`{"user.team_id": {"$exists": true}}`, []int{0, 1, 4}},
+		{`{"user.team_id.x": {"$exists": true}}`, []int{}},
+		{`{"user": {"team_id": 6}}`, []int{1}},
+		// An array matches if any element does, or if it's equal as a whole
+		{`{"tags": "b"}`, []int{0, 1}},
+		{`{"tags": ["b"]}`, []int{1}},
+		{`{"tags": []}`, []int{2}},
+		{`{"tags": {"$in": ["a", "z"]}}`, []int{0}},
+		{`{"tags": {"$ne": "a"}}`, []int{1, 2, 3, 4}},
+	} {
+		got := matchingIds(t, test.filter)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s matched %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestMissingFields(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		want   []int
+	}{
+		// Null matches a null value but not a missing field
+		{`{"n": null}`, []int{3}},
+		{`{"n": {"$ne": null}}`, []int{0, 1, 2, 4}},
+		{`{"n": {"$lte": null}}`, []int{3}},
+		{`{"missing": {"$ne": 1}}`, []int{0, 1, 2, 3, 4}},
+		{`{"missing": {"$in": [null]}}`, []int{}},
+		{`{"missing": {"$lt": 100}}`, []int{}},
+		{`{"user.team_id": {"$ne": 5}}`, []int{1, 2, 3, 4}},
+	} {
+		got := matchingIds(t, test.filter)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s matched %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestIdValues(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		want   []int
+	}{
+		{`{"_id": 3}`, []int{3}},
+		{`{"_id": {"$in": [1, 2.5, "x", 4]}}`, []int{1, 4}},
+		{`{"$and": [{"n": 1}, {"_id": 7}]}`, []int{7}},
+	} {
+		q := parseTestQuery(t, fmt.Sprintf(`{"filter": %s}`, test.filter))
+		if fmt.Sprint(q.IdValues) != fmt.Sprint(test.want) {
+			t.Errorf("%s gave _ids %v, want %v", test.filter, q.IdValues, test.want)
+		}
+	}
+	// Either branch of an $or could match anything
+	for _, filter := range []string{`{"_id": {"$gt": 3}}`, `{"$or": [{"_id": 1}, {"n": 1}]}`} {
+		q := parseTestQuery(t, fmt.Sprintf(`{"filter": %s}`, filter))
+		if q.IdValues != nil {
+			t.Errorf("%s gave _ids %v", filter, q.IdValues)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	doc := testDocs[0]
+	for _, test := range []struct {
+		projection string
+		want       string
+	}{
+		{`{}`, `{"_id":0,"n":1,"name":"ann","tags":["a","b"],"user":{"team_id":5}}`},
+		{`{"name": 1}`, `{"_id":0,"name":"ann"}`},
+		{`{"name": true, "user.team_id": 1, "missing": 1}`, `{"_id":0,"name":"ann","user":{"team_id":5}}`},
+		{`{"name": 1, "_id": 0}`, `{"name":"ann"}`},
+		{`{"name": 0, "user.team_id": false}`, `{"_id":0,"n":1,"tags":["a","b"],"user":{}}`},
+		{`{"_id": 0}`, `{"n":1,"name":"ann","tags":["a","b"],"user":{"team_id":5}}`},
+		{`{"_id": 1}`, `{"_id":0,"n":1,"name":"ann","tags":["a","b"],"user":{"team_id":5}}`},
+	} {
+		q := parseTestQuery(t, fmt.Sprintf(`{"projection": %s}`, test.projection))
+		original := decodeTestDoc(t, doc)
+		got := encodeTestDoc(t, q.Project(original))
+		if got != test.want {
+			t.Errorf("%s projected %s, want %s", test.projection, got, test.want)
+		}
+		// Excluding fields works on a copy
+		if encodeTestDoc(t, original) != encodeTestDoc(t, decodeTestDoc(t, doc)) {
+			t.Errorf("%s changed the original document", test.projection)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	q := parseTestQuery(t, `{"sort": [{"user.team_id": -1}, {"name": 1}]}`)
+	if fmt.Sprint(q.Sort) != "[{user.team_id false} {name true}]" {
+		t.Fatalf("parsed sort %v", q.Sort)
+	}
+	docs := make([]map[string]interface{}, 0)
+	for _, data := range testDocs {
+		docs = append(docs, decodeTestDoc(t, data))
+	}
+	sort.SliceStable(docs, func(a, b int) bool { return q.Less(docs[a], docs[b]) })
+	ids := make([]int, 0)
+	for _, doc := range docs {
+		ids = append(ids, int(doc["_id"].(float64)))
+	}
+	// Strings sort after numbers and missing fields sort as null, last going down
+	if fmt.Sprint(ids) != "[4 1 0 2 3]" {
+		t.Fatalf("sorted to %v", ids)
+	}
+
+	q = parseTestQuery(t, `{"sort": {"n": 1}}`)
+	if fmt.Sprint(q.Sort) != "[{n true}]" {
+		t.Fatalf("parsed sort %v", q.Sort)
+	}
+}
+
+func TestMalformedQueries(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"filter": [1]}`,
+		`{"filter": {"n": 1}`,
+		`{"unknown": 1}`,
+		`{"limit": -1}`,
+		`{"limit": "ten"}`,
+		`{"batchSize": -1}`,
+		`{"maxBytes": -1}`,
+		`{"filter": {"$nor": []}}`,
+		`{"filter": {"$and": []}}`,
+		`{"filter": {"$or": {"n": 1}}}`,
+		`{"filter": {"$and": [1]}}`,
+		`{"filter": {"$or": [{"n": {"$bad": 1}}]}}`,
+		`{"filter": {"n": {"$bad": 1}}}`,
+		`{"filter": {"n": {"$in": 1}}}`,
+		`{"filter": {"n": {"$exists": 1}}}`,
+		`{"projection": {"n": "yes"}}`,
+		`{"projection": {"n": 1, "name": 0}}`,
+		`{"sort": "n"}`,
+		`{"sort": {"n": 1, "name": 1}}`,
+		`{"sort": [{"n": 2}]}`,
+		`{"sort": [{"n": 1, "name": 1}]}`,
+		`{"sort": [1]}`,
+	} {
+		q, err := Parse([]byte(body))
+		if err == nil {
+			t.Errorf("%s parsed to %+v", body, q)
+		}
+	}
+}
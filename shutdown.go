@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/logging"
+)
+
+// A graceful shutdown stops taking connections, waits for the
+// commands already running to finish, then checkpoints and unmaps
+// every collection. It's started by SIGINT, SIGTERM or the
+// shutdown command, whichever comes first.
+
+var shutdownRequests = make(chan string, 1)
+
+// Guards draining and the set of open connections
+var connLock = &sync.Mutex{}
+var draining bool
+var openConns = make(map[net.Conn]bool)
+var inFlight sync.WaitGroup
+
+func requestShutdown(reason string) {
+	select {
+	case shutdownRequests <- reason:
+	default:
+		// Already on its way down
+	}
+}
+
+func watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		requestShutdown(sig.String())
+	}()
+}
+
+func isDraining() bool {
+	connLock.Lock()
+	defer connLock.Unlock()
+	return draining
+}
+
+// Returns false if the connection should be turned away
+func trackConn(conn net.Conn) bool {
+	connLock.Lock()
+	defer connLock.Unlock()
+	if draining {
+		return false
+	}
+	openConns[conn] = true
+	return true
+}
+
+func untrackConn(conn net.Conn) {
+	connLock.Lock()
+	defer connLock.Unlock()
+	delete(openConns, conn)
+}
+
+// Every command runs between beginCommand and endCommand so shutdown
+// knows when it's safe to unmap. Returns false once we're draining.
+func beginCommand() bool {
+	connLock.Lock()
+	defer connLock.Unlock()
+	if draining {
+		return false
+	}
+	inFlight.Add(1)
+	return true
+}
+
+func endCommand() {
+	inFlight.Done()
+}
+
+func shutdown(listener net.Listener, httpServer *http.Server, reason string) int {
+	logging.Infof("Shutting down (%s)", reason)
+	connLock.Lock()
+	draining = true
+	connLock.Unlock()
+	listener.Close()
+
+	timeout := constants.ShutdownTimeoutSeconds * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if httpServer != nil {
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			logging.Errorln("Error stopping the HTTP gateway:", err)
+		}
+	}
+
+	drained := make(chan bool)
+	go func() {
+		inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		logging.Errorf("Commands still running after %v, shutting down anyway", timeout)
+	}
+
+	// Anyone left is sitting idle waiting on their next command
+	connLock.Lock()
+	for conn := range openConns {
+		conn.Close()
+	}
+	connLock.Unlock()
+
+	err := database.CloseAll()
+	if err != nil {
+		logging.Errorln("Error closing databases:", err)
+		return 1
+	}
+	logging.Infoln("Shutdown complete")
+	return 0
+}
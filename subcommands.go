@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gamechanger/gcdb/api"
+	"github.com/gamechanger/gcdb/constants"
+	"github.com/gamechanger/gcdb/database"
+	"github.com/gamechanger/gcdb/filesystem"
+	"github.com/gamechanger/gcdb/locks"
+	"github.com/gamechanger/gcdb/memory"
+	"github.com/gamechanger/gcdb/wal"
+)
+
+// How many lines import hands to the writer at a time
+const importBatchSize = 1000
+
+const (
+	dumpDocumentsSuffix = ".ndjson"
+	dumpIndexesSuffix   = ".indexes.json"
+)
+
+// Offline tools that work directly on the data directory, run as
+// gcdb <subcommand> [flags] [args]. They take the same flags as
+// the server, -datadir being the one that matters. Each returns
+// an exit status. They lock the data directory like the server does,
+// so none of them will run while it or another tool is using it, and
+// the ones that write to it bring an older layout up to date first.
+func runSubcommand(name string, args []string) int {
+	switch name {
+	case "verify":
+		return runVerify(args)
+	case "import":
+		return runImport(args)
+	case "export":
+		return runExport(args)
+	case "dump":
+		return runDump(args)
+	case "restore":
+		return runRestore(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %s\n", name)
+		fmt.Fprintln(os.Stderr, "Usage: gcdb [flags] | gcdb verify [flags] [database ...]\n"+
+			"  | gcdb import [flags] database collection [file] | gcdb export [flags] database collection [file]\n"+
+			"  | gcdb dump [flags] database directory | gcdb restore [flags] database directory")
+		return 2
+	}
+}
+
+// Walk every record in every collection's data files and report the
+// corrupt ones. Pass database names to only check those. Collections
+// an older release left elsewhere get checked where they are, verify
+// leaves moving them to the server.
+func runVerify(args []string) int {
+	_, dbNames, err := configure("gcdb verify", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	err = lockDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	legacyDirs, notDatabases, err := filesystem.FindLegacyLayout()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	checkLegacy := len(dbNames) == 0
+	if len(dbNames) == 0 {
+		dbNames, err = filesystem.DatabaseNames()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		dbNames = without(dbNames, notDatabases)
+	}
+
+	status := 0
+	for _, dbName := range dbNames {
+		// Where the old collections are headed
+		if dbName == constants.DefaultDatabase {
+			checkLegacy = true
+		}
+		dbDir := filesystem.DatabaseDir(dbName)
+		collNames, err := filesystem.CollectionNames(dbDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", dbName, err)
+			status = 1
+			continue
+		}
+		for _, collName := range collNames {
+			if !verifyCollection(dbName+"."+collName, filesystem.CollectionDir(dbDir, collName)) {
+				status = 1
+			}
+		}
+	}
+	if checkLegacy {
+		for _, dir := range legacyDirs {
+			fmt.Printf("Collection in %s is laid out for an older release, the server will move it into database %s when it starts\n", dir, constants.DefaultDatabase)
+			if !verifyCollection(dir, dir) {
+				status = 1
+			}
+		}
+	}
+	return status
+}
+
+// Report on the collection, returning false if any of it is corrupt
+func verifyCollection(name, dir string) bool {
+	report, err := memory.VerifyOffline(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return false
+	}
+	fmt.Printf("Collection %s\n%s\n", name, report.String())
+	return len(report.Corrupt) == 0
+}
+
+func without(names, unwanted []string) []string {
+	kept := make([]string, 0, len(names))
+	for _, name := range names {
+		skip := false
+		for _, u := range unwanted {
+			if name == u {
+				skip = true
+			}
+		}
+		if !skip {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// Load a file of newline-delimited JSON, one document per line, into a
+// collection, creating it if need be. Reads stdin without a file or
+// with -. Documents that can't be inserted are reported by line number
+// and skipped.
+func runImport(args []string) int {
+	usage := "Usage: gcdb import [flags] database collection [file]"
+	_, rest, err := configure("gcdb import", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	err = prepareDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(rest) < 2 || len(rest) > 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	dbName, collName := rest[0], rest[1]
+	input, source := os.Stdin, "stdin"
+	if len(rest) == 3 && rest[2] != "-" {
+		input, err = os.Open(rest[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer input.Close()
+		source = rest[2]
+	}
+
+	startLoading()
+	catalog, err := database.Get(dbName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	coll, err := catalog.EnsureCollection(collName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		database.CloseAll()
+		return 1
+	}
+
+	start := time.Now()
+	imported, failed, err := importDocuments(coll, input, source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		failed++
+	}
+	err = database.CloseAll()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Imported %d documents into %s.%s in %v, %d failed\n", imported, dbName, collName, time.Now().Sub(start), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Import and restore write through the server's usual write path.
+// Nobody is waiting on any one write, and closing the database at
+// the end flushes the lot, so there's no need to sync the log.
+func startLoading() {
+	memory.SetWALSyncPolicy(wal.SyncNever, 0)
+	memory.StartWriter()
+}
+
+// Insert every line of input as a document, reporting the ones that
+// can't be inserted against the line they came from in source
+func importDocuments(coll *memory.Collection, input io.Reader, source string) (imported, failed int, err error) {
+	reader := bufio.NewReader(input)
+	docs := make([]json.RawMessage, 0, importBatchSize)
+	// The line number of each document in docs
+	lines := make([]int, 0, importBatchSize)
+	lineNum := 0
+	flushBatch := func() error {
+		result, err := api.InsertMany(coll, docs, false)
+		if err != nil {
+			return err
+		}
+		imported += result.Inserted
+		for _, insertErr := range result.Errors {
+			fmt.Fprintf(os.Stderr, "%s line %d: %s\n", source, lines[insertErr.Index], insertErr.Message)
+			failed++
+		}
+		docs, lines = docs[:0], lines[:0]
+		return nil
+	}
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			lineNum++
+			if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+				docs = append(docs, json.RawMessage(trimmed))
+				lines = append(lines, lineNum)
+			}
+			if len(docs) == importBatchSize {
+				err = flushBatch()
+				if err != nil {
+					return imported, failed, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+	}
+	if len(docs) > 0 {
+		flushErr := flushBatch()
+		if err == nil {
+			err = flushErr
+		}
+	}
+	return imported, failed, err
+}
+
+// Write every live document in a collection out as newline-delimited
+// JSON, to stdout without a file or with -. Reads the data files
+// directly, so the server must have been shut down cleanly and not be
+// running. gcdb import reads the output back in.
+func runExport(args []string) int {
+	usage := "Usage: gcdb export [flags] database collection [file]"
+	_, rest, err := configure("gcdb export", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	err = lockDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(rest) < 2 || len(rest) > 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	dbName, collName := rest[0], rest[1]
+	dir, err := offlineCollectionDir(dbName, collName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	output := os.Stdout
+	if len(rest) == 3 && rest[2] != "-" {
+		output, err = os.Create(rest[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer output.Close()
+	}
+
+	start := time.Now()
+	numDocs, err := exportCollection(dir, output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d documents from %s.%s in %v\n", numDocs, dbName, collName, time.Now().Sub(start))
+	return 0
+}
+
+func offlineCollectionDir(dbName, collName string) (string, error) {
+	dir := filesystem.CollectionDir(filesystem.DatabaseDir(dbName), collName)
+	if _, err := os.Stat(dir); err != nil {
+		return "", errors.New(fmt.Sprintf("No collection %s.%s in the data directory", dbName, collName))
+	}
+	return dir, nil
+}
+
+func exportCollection(dir string, output io.Writer) (int, error) {
+	writer := bufio.NewWriter(output)
+	numDocs, err := memory.ExportOffline(dir, func(data []byte) error {
+		_, err := writer.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return numDocs, err
+	}
+	return numDocs, writer.Flush()
+}
+
+// A dump is a directory holding two files for each collection:
+// <collection>.ndjson with its documents, one per line, and
+// <collection>.indexes.json with the paths of its secondary
+// indexes as a JSON array. Restore loads it into any database,
+// on this host or another.
+
+// Dump every collection in a database into a directory, creating it
+// if need be. Reads the data files directly, so the server must have
+// been shut down cleanly and not be running.
+func runDump(args []string) int {
+	usage := "Usage: gcdb dump [flags] database directory"
+	_, rest, err := configure("gcdb dump", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	err = lockDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(rest) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	dbName, dumpDir := rest[0], rest[1]
+	dbDir := filesystem.DatabaseDir(dbName)
+	collNames, err := filesystem.CollectionNames(dbDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "No database %s in the data directory: %v\n", dbName, err)
+		return 1
+	}
+	err = filesystem.EnsureDir(dumpDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, collName := range collNames {
+		numDocs, numIndexes, err := dumpCollection(filesystem.CollectionDir(dbDir, collName), dumpDir, collName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s.%s: %v\n", dbName, collName, err)
+			return 1
+		}
+		fmt.Printf("Dumped %d documents and %d indexes from %s.%s\n", numDocs, numIndexes, dbName, collName)
+	}
+	return 0
+}
+
+func dumpCollection(dir, dumpDir, collName string) (int, int, error) {
+	paths, err := memory.ReadIndexDefinitions(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	output, err := os.Create(filepath.Join(dumpDir, collName+dumpDocumentsSuffix))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer output.Close()
+	numDocs, err := exportCollection(dir, output)
+	if err != nil {
+		return numDocs, 0, err
+	}
+	err = output.Sync()
+	if err != nil {
+		return numDocs, 0, err
+	}
+
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return numDocs, 0, err
+	}
+	err = filesystem.WriteFileAtomically(filepath.Join(dumpDir, collName+dumpIndexesSuffix), data)
+	return numDocs, len(paths), err
+}
+
+// Load every collection in a dump into a database, creating the
+// database and collections if need be and building their indexes
+// once the documents are in. Documents whose _id is already taken
+// are reported and skipped.
+func runRestore(args []string) int {
+	usage := "Usage: gcdb restore [flags] database directory"
+	_, rest, err := configure("gcdb restore", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	err = prepareDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(rest) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	dbName, dumpDir := rest[0], rest[1]
+	dumpFiles, err := filepath.Glob(filepath.Join(dumpDir, "*"+dumpDocumentsSuffix))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(dumpFiles) == 0 {
+		fmt.Fprintf(os.Stderr, "No dumped collections in %s\n", dumpDir)
+		return 1
+	}
+	sort.Strings(dumpFiles)
+
+	startLoading()
+	catalog, err := database.Get(dbName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	status := 0
+	for _, dumpFile := range dumpFiles {
+		collName := strings.TrimSuffix(filepath.Base(dumpFile), dumpDocumentsSuffix)
+		imported, failed, numIndexes, err := restoreCollection(catalog, dumpDir, collName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s.%s: %v\n", dbName, collName, err)
+			status = 1
+			break
+		}
+		fmt.Printf("Restored %d documents and %d indexes into %s.%s, %d failed\n", imported, numIndexes, dbName, collName, failed)
+		if failed > 0 {
+			status = 1
+		}
+	}
+
+	err = database.CloseAll()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return status
+}
+
+func restoreCollection(catalog *memory.Catalog, dumpDir, collName string) (imported, failed, numIndexes int, err error) {
+	var paths []string
+	data, err := ioutil.ReadFile(filepath.Join(dumpDir, collName+dumpIndexesSuffix))
+	if err == nil {
+		err = json.Unmarshal(data, &paths)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	coll, err := catalog.EnsureCollection(collName)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	input, err := os.Open(filepath.Join(dumpDir, collName+dumpDocumentsSuffix))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer input.Close()
+	imported, failed, err = importDocuments(coll, input, input.Name())
+	if err != nil {
+		return imported, failed, 0, err
+	}
+
+	// Building each index in one pass beats keeping it up to date on every insert
+	locks.GlobalWriteLock.Lock()
+	defer locks.GlobalWriteLock.Unlock()
+	for _, path := range paths {
+		if coll.GetSecondaryIndex(path) != nil {
+			continue
+		}
+		_, err = coll.CreateSecondaryIndex(path)
+		if err != nil {
+			return imported, failed, 0, err
+		}
+	}
+	return imported, failed, len(paths), nil
+}
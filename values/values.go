@@ -0,0 +1,101 @@
+package values
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Helpers for working with documents as decoded by encoding/json,
+// so objects are map[string]interface{} and numbers are float64
+
+// Values of different types sort in this order
+const (
+	rankNull = iota
+	rankNumber
+	rankString
+	rankBool
+	rankObject
+	rankArray
+)
+
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return rankNull
+	case float64, int:
+		return rankNumber
+	case string:
+		return rankString
+	case bool:
+		return rankBool
+	case map[string]interface{}:
+		return rankObject
+	default:
+		return rankArray
+	}
+}
+
+func toFloat(v interface{}) float64 {
+	if i, ok := v.(int); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+// Returns -1, 0 or 1 as a is less than, equal to or greater than b
+func Compare(a, b interface{}) int {
+	rankA, rankB := rank(a), rank(b)
+	if rankA != rankB {
+		if rankA < rankB {
+			return -1
+		}
+		return 1
+	}
+	switch rankA {
+	case rankNull:
+		return 0
+	case rankNumber:
+		fa, fb := toFloat(a), toFloat(b)
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+		return 0
+	case rankString:
+		return strings.Compare(a.(string), b.(string))
+	case rankBool:
+		ba, bb := a.(bool), b.(bool)
+		if ba == bb {
+			return 0
+		} else if !ba {
+			return -1
+		}
+		return 1
+	default:
+		// Good enough for equality, and at least a stable order
+		ja, _ := json.Marshal(a)
+		jb, _ := json.Marshal(b)
+		return strings.Compare(string(ja), string(jb))
+	}
+}
+
+// Follow a dotted path like user.team_id down into a document
+func Lookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, piece := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[piece]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func SameType(a, b interface{}) bool {
+	return rank(a) == rank(b)
+}
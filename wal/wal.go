@@ -0,0 +1,246 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gamechanger/gcdb/logging"
+)
+
+// The write-ahead log is a flat file of records, each one
+// First four bytes: uint32 length of the payload
+// Next four bytes: uint32 CRC-32 (IEEE) of the payload
+// Following bytes: payload
+// A record that is cut short or fails its checksum marks the point
+// where we crashed, so it and anything after it gets thrown away.
+
+const recordHeaderSize = 4 + 4
+
+type SyncPolicy int
+
+const (
+	SyncEveryWrite SyncPolicy = iota // fsync before acknowledging each write
+	SyncInterval                     // fsync every interval from a background goroutine
+	SyncNever                        // leave it up to the OS
+)
+
+type Log struct {
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	policy   SyncPolicy
+	dirty    bool
+	stopSync chan bool
+	// Once we can't say what made it into the log every
+	// append gets refused with this instead
+	failed error
+}
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncEveryWrite, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncNever, errors.New(fmt.Sprintf("Unknown fsync policy %s, must be one of always, interval or never", s))
+}
+
+func Open(path string, policy SyncPolicy, interval time.Duration) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{file: file, policy: policy}
+	if policy == SyncInterval {
+		l.stopSync = make(chan bool)
+		go l.syncEvery(interval)
+	}
+	return l, nil
+}
+
+func (l *Log) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopSync:
+			return
+		case <-ticker.C:
+			l.lock.Lock()
+			if l.dirty && l.failed == nil {
+				err := l.file.Sync()
+				if err != nil {
+					l.fail(err)
+				} else {
+					l.dirty = false
+				}
+			}
+			l.lock.Unlock()
+		}
+	}
+}
+
+// Read back every intact record in the log, handing each payload
+// to apply in order, and chop off any torn record at the end
+func (l *Log) Replay(apply func(payload []byte) error) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	fileInfo, err := l.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	_, err = l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(l.file)
+	header := make([]byte, recordHeaderSize)
+	goodOffset := int64(0)
+	numRecords := 0
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			logging.Errorf("Write-ahead log ends with a torn record header at offset %d", goodOffset)
+			break
+		}
+		if err != nil {
+			return numRecords, err
+		}
+		// A torn header can claim any length at all, so don't
+		// go allocating more than is left in the file
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		if length > fileInfo.Size()-goodOffset-recordHeaderSize {
+			logging.Errorf("Write-ahead log record at offset %d claims %d bytes, more than are left in the log", goodOffset, length)
+			break
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			logging.Errorf("Write-ahead log ends with a torn record at offset %d", goodOffset)
+			break
+		}
+		if err != nil {
+			return numRecords, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			logging.Errorf("Write-ahead log record at offset %d failed its checksum", goodOffset)
+			break
+		}
+		err = apply(payload)
+		if err != nil {
+			return numRecords, err
+		}
+		goodOffset += int64(recordHeaderSize + len(payload))
+		numRecords++
+	}
+
+	err = l.file.Truncate(goodOffset)
+	if err != nil {
+		return numRecords, err
+	}
+	_, err = l.file.Seek(goodOffset, io.SeekStart)
+	if err != nil {
+		return numRecords, err
+	}
+	l.size = goodOffset
+	return numRecords, l.file.Sync()
+}
+
+// Append a record, returning once it is as durable as the sync policy promises
+func (l *Log) Append(payload []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.failed != nil {
+		return l.failed
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+	_, err := l.file.Write(record)
+	if err != nil {
+		// Replay stops at a torn record, so anything appended after
+		// part of this one would be lost. Cut it back off.
+		rollbackErr := l.file.Truncate(l.size)
+		if rollbackErr == nil {
+			_, rollbackErr = l.file.Seek(l.size, io.SeekStart)
+		}
+		if rollbackErr != nil {
+			l.fail(rollbackErr)
+		}
+		return err
+	}
+	l.size += int64(len(record))
+	if l.policy == SyncEveryWrite {
+		err = l.file.Sync()
+		if err != nil {
+			// No telling what made it to disk after a failed fsync,
+			// or whether retrying would really sync it
+			l.fail(err)
+			return l.failed
+		}
+		return nil
+	}
+	l.dirty = true
+	return nil
+}
+
+// Stop taking writes. Whatever was already appended may or may not
+// be there after a restart. Called with the lock held.
+func (l *Log) fail(err error) {
+	l.failed = errors.New(fmt.Sprintf("Write-ahead log failed and is refusing writes until a restart: %s", err))
+	logging.Errorln(l.failed)
+}
+
+func (l *Log) Size() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.size
+}
+
+// Throw away every record. Only safe once everything they
+// describe has been flushed to the data files.
+func (l *Log) Truncate() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	l.size = 0
+	l.dirty = false
+	return l.file.Sync()
+}
+
+func (l *Log) Close() error {
+	if l.stopSync != nil {
+		close(l.stopSync)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.file.Sync()
+	if err != nil {
+		return err
+	}
+	return l.file.Close()
+}
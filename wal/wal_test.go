@@ -0,0 +1,257 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func openTestLog(t *testing.T, path string) *Log {
+	t.Helper()
+	l, err := Open(path, SyncEveryWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// Write the payloads to a fresh log and close it
+func writeTestLog(t *testing.T, payloads ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l := openTestLog(t, path)
+	for _, payload := range payloads {
+		err := l.Append([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func appendRaw(t *testing.T, path string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileInfo.Size()
+}
+
+// Replay the log at path, returning the payloads it handed out
+func replayTestLog(t *testing.T, path string) (*Log, []string) {
+	t.Helper()
+	l := openTestLog(t, path)
+	replayed := make([]string, 0)
+	n, err := l.Replay(func(payload []byte) error {
+		replayed = append(replayed, string(payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(replayed) {
+		t.Fatalf("replay says %d records but applied %d", n, len(replayed))
+	}
+	return l, replayed
+}
+
+func expectPayloads(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Fatalf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestReplayReturnsRecordsInOrder(t *testing.T) {
+	path := writeTestLog(t, "one", "two", "", "three")
+	l, replayed := replayTestLog(t, path)
+	defer l.Close()
+	expectPayloads(t, replayed, "one", "two", "", "three")
+	if l.Size() != fileSize(t, path) {
+		t.Fatalf("log thinks it's %d bytes, file is %d", l.Size(), fileSize(t, path))
+	}
+}
+
+func TestReplayDropsTornTail(t *testing.T) {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, 10)
+	tails := map[string][]byte{
+		"header":  {0, 0},
+		"payload": append(header, []byte("short")...),
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestLog(t, "one", "two")
+			intact := fileSize(t, path)
+			appendRaw(t, path, tail)
+
+			l, replayed := replayTestLog(t, path)
+			expectPayloads(t, replayed, "one", "two")
+			if fileSize(t, path) != intact {
+				t.Fatalf("log is %d bytes after replay, want the %d intact ones", fileSize(t, path), intact)
+			}
+
+			// New records go where the torn one was
+			err := l.Append([]byte("three"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+			l, replayed = replayTestLog(t, path)
+			defer l.Close()
+			expectPayloads(t, replayed, "one", "two", "three")
+		})
+	}
+}
+
+func TestReplayStopsAtChecksumMismatch(t *testing.T) {
+	path := writeTestLog(t, "one", "two", "three")
+	// Flip a byte of the second payload, the third can't be trusted either
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("X"), int64(recordHeaderSize+len("one")+recordHeaderSize))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, replayed := replayTestLog(t, path)
+	defer l.Close()
+	expectPayloads(t, replayed, "one")
+	if fileSize(t, path) != int64(recordHeaderSize+len("one")) {
+		t.Fatalf("log is %d bytes after replay", fileSize(t, path))
+	}
+}
+
+func TestReplayIgnoresLengthPastEndOfLog(t *testing.T) {
+	path := writeTestLog(t, "one")
+	header := make([]byte, recordHeaderSize)
+	// Would be a 4 GiB allocation if we believed it
+	binary.BigEndian.PutUint32(header, 0xFFFFFFFF)
+	appendRaw(t, path, append(header, []byte("garbage")...))
+
+	l, replayed := replayTestLog(t, path)
+	defer l.Close()
+	expectPayloads(t, replayed, "one")
+}
+
+func TestReplayStopsAtApplyError(t *testing.T) {
+	path := writeTestLog(t, "one", "two")
+	l := openTestLog(t, path)
+	defer l.Close()
+	failure := errors.New("can't apply")
+	n, err := l.Replay(func(payload []byte) error {
+		if string(payload) == "two" {
+			return failure
+		}
+		return nil
+	})
+	if err != failure || n != 1 {
+		t.Fatalf("replay applied %d records and returned %v", n, err)
+	}
+}
+
+func TestTruncateEmptiesLog(t *testing.T) {
+	path := writeTestLog(t, "one", "two")
+	l, _ := replayTestLog(t, path)
+	err := l.Truncate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append([]byte("three"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, replayed := replayTestLog(t, path)
+	defer l.Close()
+	expectPayloads(t, replayed, "three")
+}
+
+func TestFailedAppendLeavesNothingBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l := openTestLog(t, path)
+	err := l.Append([]byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run out of room part way through the next record
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	var limit syscall.Rlimit
+	err = syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := limit
+	small.Cur = uint64(fileSize(t, path) + recordHeaderSize + 2)
+	err = syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append([]byte("too big to fit"))
+	syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err == nil {
+		t.Fatal("append past the file size limit succeeded")
+	}
+
+	err = l.Append([]byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	l, replayed := replayTestLog(t, path)
+	defer l.Close()
+	expectPayloads(t, replayed, "one", "two")
+}
+
+func TestAppendsRefusedOnceTheLogFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l := openTestLog(t, path)
+	// Can't write the record or take it back off
+	l.file.Close()
+	if l.Append([]byte("one")) == nil {
+		t.Fatal("append to a closed file succeeded")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.file = file
+	err = l.Append([]byte("two"))
+	if err == nil || err != l.failed {
+		t.Fatalf("append to a failed log returned %v", err)
+	}
+	l.Close()
+	if fileSize(t, path) != 0 {
+		t.Fatal("a failed log took a write")
+	}
+}